@@ -0,0 +1,315 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// With TODO_AUTH=true every user has their own list. Users register with a name and a password, log in to get a token and send
+// it in the Authorization header. Items remember the user who created them in their Owner field, and all handlers only see the
+// items of the current user. Without auth there is no current user and everyone shares one list, like before.
+
+// A registered user. We never store the password itself, only a bcrypt hash of it.
+type User struct {
+	Username     string
+	PasswordHash string
+}
+
+// The body of the register and login requests.
+type Credentials struct {
+	Username string `binding:"required"`
+	Password string `binding:"required"`
+}
+
+// The result of a successful login. The token has to be sent as "Authorization: Bearer <token>" with every request.
+type LoginResult struct {
+	Token     string
+	ExpiresAt time.Time
+}
+
+// The user a token was issued for. The auth middleware puts it into the Gin context under this key.
+type TokenUser struct {
+	Username string
+	Admin    bool
+}
+
+const tokenUserKey = "tokenUser"
+
+// Usernames are used in log lines and file names of backups, so we keep them simple.
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]{3,32}$`)
+
+const minPasswordLength = 8
+
+// Auth holds the registered users and issues and checks the tokens.
+type Auth struct {
+	// File the users are saved in. Without a file users only live as long as the process.
+	path   string
+	users  map[string]User
+	secret []byte
+	ttl    time.Duration
+	admins map[string]bool
+	// Admin usernames can only be registered with this key, see Register.
+	adminKey string
+	sync.RWMutex
+}
+
+// NewAuth creates the user store from the configuration and loads the users file if there is one. Without a secret a random one
+// is generated, which means all tokens become invalid after a restart.
+func NewAuth(cfg Config) (*Auth, error) {
+	a := &Auth{
+		path:     cfg.UsersFile,
+		users:    map[string]User{},
+		secret:   []byte(cfg.JWTSecret),
+		ttl:      cfg.TokenTTL,
+		admins:   map[string]bool{},
+		adminKey: cfg.AdminAPIKey,
+	}
+	for _, name := range strings.Split(cfg.AdminUsers, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			a.admins[name] = true
+		}
+	}
+	if len(a.secret) == 0 {
+		log.Printf("TODO_JWT_SECRET is not set, using a random secret. Tokens will be invalid after a restart.")
+		a.secret = make([]byte, 32)
+		if _, err := rand.Read(a.secret); err != nil {
+			return nil, err
+		}
+	}
+	if a.path == "" {
+		return a, nil
+	}
+	data, err := ioutil.ReadFile(a.path)
+	if os.IsNotExist(err) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	list := []User{}
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("reading %v failed: %v", a.path, err)
+	}
+	for _, user := range list {
+		a.users[user.Username] = user
+	}
+	return a, nil
+}
+
+// Writes all users into the users file. The caller needs to hold the write lock.
+func (a *Auth) save() error {
+	if a.path == "" {
+		return nil
+	}
+	list := make([]User, 0, len(a.users))
+	for _, user := range a.users {
+		list = append(list, user)
+	}
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(a.path, data)
+}
+
+// Registers a new user. Anyone may register, except for the usernames listed in TODO_ADMIN_USERS. Otherwise whoever is first
+// could take an admin name before the real admin does. Those users have to be registered by an operator who sends the admin api
+// key in the X-API-Key header.
+func (a *Auth) Register(c *gin.Context) {
+	credentials := Credentials{}
+	if err := c.ShouldBindJSON(&credentials); err != nil {
+		c.String(http.StatusBadRequest, bindErrorMessage(err))
+		return
+	}
+	if !usernamePattern.MatchString(credentials.Username) {
+		c.String(http.StatusBadRequest, "Bad request: Username must have 3 to 32 letters, digits or the characters _ . -")
+		return
+	}
+	if len(credentials.Password) < minPasswordLength {
+		c.String(http.StatusBadRequest, "Bad request: Password must have at least %v characters", minPasswordLength)
+		return
+	}
+	if a.admins[credentials.Username] && !validAPIKey(c, a.adminKey) {
+		c.String(http.StatusForbidden, `Forbidden: User "%v" is an admin and can only be registered with the admin api key`, credentials.Username)
+		return
+	}
+	// bcrypt is slow on purpose, so we hash before taking the lock
+	hash, err := bcrypt.GenerateFromPassword([]byte(credentials.Password), bcrypt.DefaultCost)
+	if err != nil {
+		c.String(http.StatusBadRequest, "Bad request: %v", err)
+		return
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	if _, ok := a.users[credentials.Username]; ok {
+		c.String(http.StatusConflict, `Conflict: User "%v" already exists`, credentials.Username)
+		return
+	}
+	a.users[credentials.Username] = User{Username: credentials.Username, PasswordHash: string(hash)}
+	if err := a.save(); err != nil {
+		delete(a.users, credentials.Username)
+		log.Printf("Saving the users failed: %v", err)
+		c.String(http.StatusInternalServerError, "Internal server error: Saving the user failed")
+		return
+	}
+	c.JSON(http.StatusCreated, TokenUser{Username: credentials.Username, Admin: a.admins[credentials.Username]})
+}
+
+func (a *Auth) Login(c *gin.Context) {
+	credentials := Credentials{}
+	if err := c.ShouldBindJSON(&credentials); err != nil {
+		c.String(http.StatusBadRequest, bindErrorMessage(err))
+		return
+	}
+	a.RLock()
+	user, ok := a.users[credentials.Username]
+	a.RUnlock()
+	// The same answer for an unknown user and a wrong password, so nobody can find out which usernames exist
+	if !ok || bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(credentials.Password)) != nil {
+		c.String(http.StatusUnauthorized, "Unauthorized: Wrong username or password")
+		return
+	}
+	expires := time.Now().Add(a.ttl)
+	token, err := a.issueToken(TokenUser{Username: user.Username, Admin: a.admins[user.Username]}, expires)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Internal server error: Creating the token failed")
+		return
+	}
+	c.JSON(http.StatusOK, LoginResult{Token: token, ExpiresAt: expires.UTC()})
+}
+
+// Our tokens are JSON Web Tokens signed with HMAC-SHA256. The format is simple enough to write it ourselves instead of pulling in
+// a library: three base64 encoded parts for the header, the claims and the signature over the first two parts.
+type tokenClaims struct {
+	Subject   string `json:"sub"`
+	Admin     bool   `json:"admin,omitempty"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+var tokenHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+func (a *Auth) sign(payload string) string {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (a *Auth) issueToken(user TokenUser, expires time.Time) (string, error) {
+	claims, err := json.Marshal(tokenClaims{Subject: user.Username, Admin: user.Admin, IssuedAt: time.Now().Unix(), ExpiresAt: expires.Unix()})
+	if err != nil {
+		return "", err
+	}
+	payload := tokenHeader + "." + base64.RawURLEncoding.EncodeToString(claims)
+	return payload + "." + a.sign(payload), nil
+}
+
+// Checks the signature and the expiry of a token and returns the user it was issued for.
+func (a *Auth) parseToken(token string) (TokenUser, error) {
+	parts := strings.Split(token, ".")
+	// Only accept our own header, so a token can't switch to another algorithm like "none"
+	if len(parts) != 3 || parts[0] != tokenHeader {
+		return TokenUser{}, errors.New("malformed token")
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(a.sign(parts[0]+"."+parts[1]))) {
+		return TokenUser{}, errors.New("invalid signature")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return TokenUser{}, errors.New("malformed token")
+	}
+	claims := tokenClaims{}
+	if err := json.Unmarshal(data, &claims); err != nil || claims.Subject == "" {
+		return TokenUser{}, errors.New("malformed token")
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return TokenUser{}, errors.New("token expired")
+	}
+	return TokenUser{Username: claims.Subject, Admin: claims.Admin}, nil
+}
+
+// RequireToken returns a Gin middleware which only lets requests through that send a valid token. The user of the token is
+// stored in the context, see currentUser.
+func (a *Auth) RequireToken() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		header := c.GetHeader("Authorization")
+		if !strings.HasPrefix(header, "Bearer ") {
+			c.Header("WWW-Authenticate", "Bearer")
+			c.String(http.StatusUnauthorized, "Unauthorized: A bearer token is required, log in at /api/users/login")
+			c.Abort()
+			return
+		}
+		user, err := a.parseToken(strings.TrimPrefix(header, "Bearer "))
+		if err != nil {
+			c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+			c.String(http.StatusUnauthorized, "Unauthorized: %v", err)
+			c.Abort()
+			return
+		}
+		// The admin flag in the token is only a hint for clients. TODO_ADMIN_USERS decides on every request, so removing a name
+		// from it takes effect with the next restart instead of when the last token of that user expires.
+		user.Admin = a.admins[user.Username]
+		c.Set(tokenUserKey, user)
+		c.Next()
+	}
+}
+
+// Returns the user of the request. Without auth there is none.
+func currentUser(c *gin.Context) (TokenUser, bool) {
+	value, ok := c.Get(tokenUserKey)
+	if !ok {
+		return TokenUser{}, false
+	}
+	user, ok := value.(TokenUser)
+	return user, ok
+}
+
+// Returns the owner for items created by the request, which is empty without auth.
+func ownerOf(c *gin.Context) string {
+	user, _ := currentUser(c)
+	return user.Username
+}
+
+// Reports whether the request may see and change the item. Without auth every item is visible, otherwise only the own ones.
+func visible(c *gin.Context, item TodoItem) bool {
+	user, ok := currentUser(c)
+	return !ok || item.Owner == user.Username
+}
+
+// Returns the item with the given id if it exists and is visible to the request. Items of other users are treated as if they
+// didn't exist, so nobody can find out which ids are taken. The caller needs to hold the lock.
+func (th *TodoHandler) lookup(c *gin.Context, id int) (TodoItem, bool) {
+	item, ok := th.items[id]
+	if !ok || !visible(c, item) {
+		return TodoItem{}, false
+	}
+	return item, true
+}
+
+// Returns all items visible to the request in no particular order. The caller needs to hold the lock.
+func (th *TodoHandler) visibleItems(c *gin.Context) TodoItemCollection {
+	items := make(TodoItemCollection, 0, len(th.items))
+	for _, item := range th.items {
+		if visible(c, item) {
+			items = append(items, item)
+		}
+	}
+	return items
+}
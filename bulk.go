@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// An update of a bulk request. Besides the id it has the same fields as a PUT body.
+type BulkUpdate struct {
+	Id int
+	PutTodoItem
+}
+
+// The body of a bulk request. Every list is optional.
+type BulkRequest struct {
+	Creates []PostTodoItem
+	Updates []BulkUpdate
+	Deletes []int
+}
+
+// The result of the Bulk function, with all items as they are stored after the request.
+type BulkResult struct {
+	Created TodoItemCollection
+	Updated TodoItemCollection
+	Deleted []int
+}
+
+// Creates, updates and deletes many items in one request. It's atomic, so if one of the changes fails, or the store fails to save
+// them, none of them are stored.
+// Deletes go first, then the updates and then the creates, so dependencies are checked against the final list.
+func (th *TodoHandler) Bulk(c *gin.Context) {
+	request := BulkRequest{}
+	if err := th.bindJSON(c, &request); err != nil {
+		c.String(http.StatusBadRequest, bindErrorMessage(err))
+		return
+	}
+	// Gin only runs the binding validation for structs, not for the items of a slice, so we validate every item ourselves
+	creates := make([]PutTodoItem, len(request.Creates))
+	for i, item := range request.Creates {
+		creates[i] = item.putItem()
+		if err := validatePut(&creates[i]); err != nil {
+			c.String(http.StatusBadRequest, "Bad request: Creates %v: %v", i, err)
+			return
+		}
+	}
+	seen := map[int]bool{}
+	for i := range request.Updates {
+		if err := validatePut(&request.Updates[i].PutTodoItem); err != nil {
+			c.String(http.StatusBadRequest, "Bad request: Updates %v: %v", i, err)
+			return
+		}
+		if seen[request.Updates[i].Id] {
+			c.String(http.StatusBadRequest, `Bad request: Item with id "%v" is listed twice`, request.Updates[i].Id)
+			return
+		}
+		seen[request.Updates[i].Id] = true
+	}
+	for _, id := range request.Deletes {
+		if seen[id] {
+			c.String(http.StatusBadRequest, `Bad request: Item with id "%v" is listed twice`, id)
+			return
+		}
+		seen[id] = true
+	}
+
+	th.Lock()
+	defer th.Unlock()
+	openBefore := th.openItems(ownerOf(c))
+	rollback := th.snapshot()
+	for _, id := range request.Deletes {
+		if _, ok := th.lookup(c, id); !ok {
+			rollback()
+			c.String(http.StatusNotFound, `Not found: Item with id "%v"`, id)
+			return
+		}
+		delete(th.items, id)
+		th.removeDependency(id)
+	}
+	for _, update := range request.Updates {
+		item, ok := th.lookup(c, update.Id)
+		if !ok {
+			rollback()
+			c.String(http.StatusNotFound, `Not found: Item with id "%v"`, update.Id)
+			return
+		}
+		if status, msg := th.putRules(item, update.PutTodoItem); status != 0 {
+			rollback()
+			c.String(status, msg)
+			return
+		}
+		if updated := applyPut(item, update.PutTodoItem); len(diffItems(item, updated)) > 0 {
+			th.items[item.Id] = th.touch(updated)
+		}
+	}
+	created := []int{}
+	for _, putItem := range creates {
+		if status, msg := th.createRules(ownerOf(c), putItem); status != 0 {
+			rollback()
+			c.String(status, msg)
+			return
+		}
+		created = append(created, th.create(ownerOf(c), putItem).Id)
+	}
+	// Like for a sync, a request which completes more items than it opens is always allowed
+	if open := th.openItems(ownerOf(c)); th.maxOpenItems > 0 && open > th.maxOpenItems && open > openBefore {
+		rollback()
+		c.String(http.StatusConflict, "Conflict: The limit of %v open items is reached, complete an item first", th.maxOpenItems)
+		return
+	}
+
+	th.ensureUniquePositions()
+	if err := th.save(); err != nil {
+		rollback()
+		c.String(http.StatusInternalServerError, "Internal server error: Saving the changes failed")
+		return
+	}
+	// Read the items again at the end, as deletes and rebalancing may have changed them after they were written
+	result := BulkResult{Created: TodoItemCollection{}, Updated: TodoItemCollection{}, Deleted: []int{}}
+	for _, id := range created {
+		result.Created = append(result.Created, th.items[id])
+	}
+	for _, update := range request.Updates {
+		result.Updated = append(result.Updated, th.items[update.Id])
+	}
+	result.Deleted = append(result.Deleted, request.Deletes...)
+	th.warnOpenItemsLimit(c, th.openItems(ownerOf(c)))
+	c.JSON(http.StatusOK, result)
+}
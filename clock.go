@@ -0,0 +1,22 @@
+package main
+
+import "time"
+
+// A Clock tells the current time. The handler asks its clock instead of calling time.Now() directly, so the time can be faked or
+// corrected by a fixed offset, e.g. if the server clock is known to drift.
+type Clock interface {
+	Now() time.Time
+}
+
+// The real system clock.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// A clock which shifts the time of another clock by a fixed offset.
+type offsetClock struct {
+	clock  Clock
+	offset time.Duration
+}
+
+func (o offsetClock) Now() time.Time { return o.clock.Now().Add(o.offset) }
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Config holds all settings of the service. They are read from environment variables, see the README for the full list.
+type Config struct {
+	Store                       string
+	DataFile                    string
+	DatabaseDSN                 string
+	ServerTiming                bool
+	APIVersion                  string
+	IDFormat                    string
+	IDPrefix                    string
+	ClockOffset                 time.Duration
+	ProductiveMinutesPerDay     int
+	BlockIncompleteDependencies bool
+	LockCompletedItems          bool
+	ForbidReopening             bool
+	MaxOpenItems                int
+	SoftLimitPercent            int
+	LenientJSON                 bool
+	SkipNoopUpdates             bool
+	AdminAPIKey                 string
+	Auth                        bool
+	UsersFile                   string
+	JWTSecret                   string
+	TokenTTL                    time.Duration
+	AdminUsers                  string
+	ListenAddr                  string
+	TLSCertFile                 string
+	TLSKeyFile                  string
+	ReadTimeout                 time.Duration
+	WriteTimeout                time.Duration
+	IdleTimeout                 time.Duration
+	ShutdownTimeout             time.Duration
+	GinMode                     string
+	RateLimit                   int
+	RateBurst                   int
+	TrustedProxies              string
+	Tracing                     bool
+	ServiceName                 string
+}
+
+// LoadConfig reads the configuration from the environment. Unset variables keep their defaults, but a value which can't be
+// parsed is an error, so a typo doesn't silently switch a feature off.
+func LoadConfig() (Config, error) {
+	cfg := Config{
+		APIVersion:              version,
+		ProductiveMinutesPerDay: 8 * 60,
+		SoftLimitPercent:        80,
+		TokenTTL:                24 * time.Hour,
+		ListenAddr:              ":8080",
+		ReadTimeout:             30 * time.Second,
+		IdleTimeout:             2 * time.Minute,
+		ShutdownTimeout:         15 * time.Second,
+		ServiceName:             "todo-list-example",
+	}
+	var err error
+	// Every helper below does nothing once err is set, so we only have to check it once at the end
+	str := func(name string, target *string) {
+		if v, ok := os.LookupEnv(name); ok && v != "" {
+			*target = v
+		}
+	}
+	boolean := func(name string, target *bool) {
+		if v, ok := os.LookupEnv(name); ok && v != "" && err == nil {
+			if *target, err = strconv.ParseBool(v); err != nil {
+				err = fmt.Errorf("%v must be true or false: %v", name, err)
+			}
+		}
+	}
+	integer := func(name string, target *int) {
+		if v, ok := os.LookupEnv(name); ok && v != "" && err == nil {
+			if *target, err = strconv.Atoi(v); err != nil || *target < 0 {
+				err = fmt.Errorf("%v must be a number greater or equal to 0", name)
+			}
+		}
+	}
+	duration := func(name string, target *time.Duration) {
+		if v, ok := os.LookupEnv(name); ok && v != "" && err == nil {
+			if *target, err = time.ParseDuration(v); err != nil {
+				err = fmt.Errorf("%v must be a duration like 1.5s: %v", name, err)
+			}
+		}
+	}
+
+	str("TODO_STORE", &cfg.Store)
+	str("TODO_DATA_FILE", &cfg.DataFile)
+	str("TODO_DATABASE_DSN", &cfg.DatabaseDSN)
+	boolean("TODO_SERVER_TIMING", &cfg.ServerTiming)
+	str("TODO_API_VERSION", &cfg.APIVersion)
+	str("TODO_ID_FORMAT", &cfg.IDFormat)
+	str("TODO_ID_PREFIX", &cfg.IDPrefix)
+	duration("TODO_CLOCK_OFFSET", &cfg.ClockOffset)
+	integer("TODO_PRODUCTIVE_MINUTES_PER_DAY", &cfg.ProductiveMinutesPerDay)
+	boolean("TODO_BLOCK_INCOMPLETE_DEPENDENCIES", &cfg.BlockIncompleteDependencies)
+	boolean("TODO_LOCK_COMPLETED_ITEMS", &cfg.LockCompletedItems)
+	boolean("TODO_FORBID_REOPENING", &cfg.ForbidReopening)
+	integer("TODO_MAX_OPEN_ITEMS", &cfg.MaxOpenItems)
+	integer("TODO_SOFT_LIMIT_PERCENT", &cfg.SoftLimitPercent)
+	boolean("TODO_LENIENT_JSON", &cfg.LenientJSON)
+	boolean("TODO_SKIP_NOOP_UPDATES", &cfg.SkipNoopUpdates)
+	str("TODO_ADMIN_API_KEY", &cfg.AdminAPIKey)
+	boolean("TODO_AUTH", &cfg.Auth)
+	str("TODO_USERS_FILE", &cfg.UsersFile)
+	str("TODO_JWT_SECRET", &cfg.JWTSecret)
+	duration("TODO_TOKEN_TTL", &cfg.TokenTTL)
+	str("TODO_ADMIN_USERS", &cfg.AdminUsers)
+	// Gin listens on $PORT by default, so it keeps working as long as no address is configured
+	if port := os.Getenv("PORT"); port != "" {
+		cfg.ListenAddr = ":" + port
+	}
+	str("TODO_LISTEN_ADDR", &cfg.ListenAddr)
+	str("TODO_TLS_CERT_FILE", &cfg.TLSCertFile)
+	str("TODO_TLS_KEY_FILE", &cfg.TLSKeyFile)
+	duration("TODO_READ_TIMEOUT", &cfg.ReadTimeout)
+	duration("TODO_WRITE_TIMEOUT", &cfg.WriteTimeout)
+	duration("TODO_IDLE_TIMEOUT", &cfg.IdleTimeout)
+	duration("TODO_SHUTDOWN_TIMEOUT", &cfg.ShutdownTimeout)
+	str("TODO_GIN_MODE", &cfg.GinMode)
+	integer("TODO_RATE_LIMIT", &cfg.RateLimit)
+	integer("TODO_RATE_BURST", &cfg.RateBurst)
+	str("TODO_TRUSTED_PROXIES", &cfg.TrustedProxies)
+	boolean("TODO_TRACING", &cfg.Tracing)
+	str("TODO_SERVICE_NAME", &cfg.ServiceName)
+	if err == nil && cfg.ProductiveMinutesPerDay == 0 {
+		err = fmt.Errorf("TODO_PRODUCTIVE_MINUTES_PER_DAY must be greater than 0")
+	}
+	if err == nil && cfg.TokenTTL <= 0 {
+		err = fmt.Errorf("TODO_TOKEN_TTL must be greater than 0")
+	}
+	if err == nil && (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		err = fmt.Errorf("TODO_TLS_CERT_FILE and TODO_TLS_KEY_FILE must be set together")
+	}
+	if err == nil && cfg.GinMode != "" && cfg.GinMode != gin.DebugMode && cfg.GinMode != gin.ReleaseMode && cfg.GinMode != gin.TestMode {
+		err = fmt.Errorf("TODO_GIN_MODE must be debug, release or test")
+	}
+	// Without a burst a client could never send more than one request at once
+	if err == nil && cfg.RateBurst == 0 {
+		cfg.RateBurst = 2 * cfg.RateLimit
+	}
+	return cfg, err
+}
+
+// Applies the configuration to the handler. Returns an error if the id format is invalid.
+func (cfg Config) Apply(th *TodoHandler) error {
+	parseID, err := NewIDParser(cfg.IDFormat, cfg.IDPrefix)
+	if err != nil {
+		return err
+	}
+	th.parseID = parseID
+	th.formatID = NewIDFormatter(cfg.IDFormat, cfg.IDPrefix)
+	if cfg.ClockOffset != 0 {
+		th.clock = offsetClock{clock: th.clock, offset: cfg.ClockOffset}
+	}
+	th.productiveMinutesPerDay = cfg.ProductiveMinutesPerDay
+	th.blockOnIncompleteDependencies = cfg.BlockIncompleteDependencies
+	th.lockCompletedItems = cfg.LockCompletedItems
+	th.allowReopen = !cfg.ForbidReopening
+	th.maxOpenItems = cfg.MaxOpenItems
+	th.softLimitPercent = cfg.SoftLimitPercent
+	th.lenientJSON = cfg.LenientJSON
+	th.skipNoopUpdates = cfg.SkipNoopUpdates
+	return nil
+}
+
+// Returns the comma separated TrustedProxies as a list. Empty if no proxy is trusted.
+func (cfg Config) trustedProxies() []string {
+	proxies := []string{}
+	for _, proxy := range strings.Split(cfg.TrustedProxies, ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			proxies = append(proxies, proxy)
+		}
+	}
+	return proxies
+}
+
+// Returns a copy of the configuration which is safe to show, with all secrets replaced.
+func (cfg Config) Redacted() Config {
+	if cfg.AdminAPIKey != "" {
+		cfg.AdminAPIKey = "[redacted]"
+	}
+	// A DSN usually contains the database password
+	if cfg.DatabaseDSN != "" {
+		cfg.DatabaseDSN = "[redacted]"
+	}
+	if cfg.JWTSecret != "" {
+		cfg.JWTSecret = "[redacted]"
+	}
+	return cfg
+}
+
+// Returns a handler which shows the effective configuration, so operators can see what the service is actually running with.
+func ConfigHandler(cfg Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, cfg.Redacted())
+	}
+}
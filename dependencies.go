@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Items can depend on other items using their DependsOn ids. Together they form a directed graph which must not contain cycles,
+// otherwise two tasks would wait on each other forever.
+
+// Checks the dependencies of the item with the given id. It returns a 400 or 409 status and a message if they are invalid.
+// Every dependency must exist, belong to the same owner and following them must never lead back to the item itself. As items only
+// depend on items of their own owner, a cycle can never span several users. The caller needs to hold the lock.
+func (th *TodoHandler) checkDependencies(owner string, id int, dependsOn []int) (int, string) {
+	for _, dep := range dependsOn {
+		if item, ok := th.items[dep]; !ok || item.Owner != owner {
+			return http.StatusBadRequest, fmt.Sprintf(`Bad request: DependsOn references unknown item "%v"`, dep)
+		}
+	}
+	if th.reaches(dependsOn, id) {
+		return http.StatusConflict, fmt.Sprintf(`Conflict: DependsOn of item "%v" would create a cycle`, id)
+	}
+	return 0, ""
+}
+
+// Reports whether the target id can be reached by following the dependencies starting at the given ids.
+func (th *TodoHandler) reaches(start []int, target int) bool {
+	visited := map[int]bool{}
+	stack := append([]int{}, start...)
+	for len(stack) > 0 {
+		id := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if id == target {
+			return true
+		}
+		if visited[id] {
+			continue
+		}
+		visited[id] = true
+		stack = append(stack, th.items[id].DependsOn...)
+	}
+	return false
+}
+
+// Returns the ids of all dependencies which are not completed yet, in ascending order. The caller needs to hold the lock.
+func (th *TodoHandler) blockingDependencies(dependsOn []int) []int {
+	blocking := []int{}
+	for _, dep := range dependsOn {
+		if item, ok := th.items[dep]; ok && !item.IsComplete {
+			blocking = append(blocking, dep)
+		}
+	}
+	sort.Ints(blocking)
+	return blocking
+}
+
+// Removes the given id from the dependencies of all other items, so deleting an item leaves no dangling references behind.
+// The caller needs to hold the write lock.
+func (th *TodoHandler) removeDependency(id int) {
+	for otherID, item := range th.items {
+		deps := []int{}
+		for _, dep := range item.DependsOn {
+			if dep != id {
+				deps = append(deps, dep)
+			}
+		}
+		if len(deps) == len(item.DependsOn) {
+			continue
+		}
+		item.DependsOn = nil
+		if len(deps) > 0 {
+			item.DependsOn = deps
+		}
+		th.items[otherID] = item
+	}
+}
+
+// Returns the ids without duplicates, keeping the order of their first occurrence. Depending on the same item twice means nothing
+// more than depending on it once, but a second copy would survive when the first one is removed.
+func uniqueIDs(ids []int) []int {
+	result := []int{}
+	seen := map[int]bool{}
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			result = append(result, id)
+		}
+	}
+	return result
+}
+
+// A node of the dependency graph, which is just a slim version of our TodoItem.
+type GraphNode struct {
+	Id         int
+	Name       string
+	IsComplete bool
+}
+
+// An edge pointing from an item to one of the items it depends on.
+type GraphEdge struct {
+	From int
+	To   int
+}
+
+// The result of the GetGraph function. Cycles should always be empty because we reject them on writes, but we report them anyway
+// so clients can notice if something went wrong.
+type Graph struct {
+	Nodes  []GraphNode
+	Edges  []GraphEdge
+	Cycles [][]int
+}
+
+func (th *TodoHandler) GetGraph(c *gin.Context) {
+	th.RLock()
+	defer th.RUnlock()
+
+	ids := []int{}
+	for _, item := range th.visibleItems(c) {
+		ids = append(ids, item.Id)
+	}
+	sort.Ints(ids)
+
+	graph := Graph{Nodes: []GraphNode{}, Edges: []GraphEdge{}, Cycles: [][]int{}}
+	for _, id := range ids {
+		item := th.items[id]
+		graph.Nodes = append(graph.Nodes, GraphNode{Id: item.Id, Name: item.Name, IsComplete: item.IsComplete})
+		for _, dep := range item.DependsOn {
+			graph.Edges = append(graph.Edges, GraphEdge{From: item.Id, To: dep})
+		}
+	}
+	graph.Cycles = th.findCycles(ids)
+	c.JSON(http.StatusOK, graph)
+}
+
+// A depth first search which remembers the current path. Reaching an item which is still on the path means we walked in a circle.
+func (th *TodoHandler) findCycles(ids []int) [][]int {
+	const (
+		unvisited = iota
+		onPath
+		done
+	)
+	state := map[int]int{}
+	cycles := [][]int{}
+	path := []int{}
+
+	var visit func(id int)
+	visit = func(id int) {
+		state[id] = onPath
+		path = append(path, id)
+		for _, dep := range th.items[id].DependsOn {
+			switch state[dep] {
+			case unvisited:
+				visit(dep)
+			case onPath:
+				for i := len(path) - 1; i >= 0; i-- {
+					if path[i] == dep {
+						cycles = append(cycles, append([]int{}, path[i:]...))
+						break
+					}
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		state[id] = done
+	}
+
+	for _, id := range ids {
+		if state[id] == unvisited {
+			visit(id)
+		}
+	}
+	return cycles
+}
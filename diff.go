@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The old and the new value of a single field.
+type FieldChange struct {
+	Old interface{}
+	New interface{}
+}
+
+// Compares two versions of an item field by field and returns the changed fields keyed by their name. We use reflection to walk
+// over the fields, so new fields of TodoItem are picked up automatically.
+func diffItems(old, new TodoItem) map[string]FieldChange {
+	changes := map[string]FieldChange{}
+	oldValue, newValue := reflect.ValueOf(old), reflect.ValueOf(new)
+	for i := 0; i < oldValue.NumField(); i++ {
+		o, n := oldValue.Field(i).Interface(), newValue.Field(i).Interface()
+		if !reflect.DeepEqual(o, n) {
+			changes[oldValue.Type().Field(i).Name] = FieldChange{Old: o, New: n}
+		}
+	}
+	return changes
+}
+
+// The result of the PreviewUpdate function.
+type UpdatePreview struct {
+	Changes map[string]FieldChange
+}
+
+// Shows what a PUT with the same body would change, without storing anything.
+func (th *TodoHandler) PreviewUpdate(c *gin.Context) {
+	putItem, ok := th.bindPutItem(c)
+	if !ok {
+		return
+	}
+
+	id, err := th.parseID(c.Param("id"))
+	if err != nil {
+		c.String(http.StatusBadRequest, "Bad request: Id in url is not a valid id")
+		return
+	}
+
+	th.RLock()
+	defer th.RUnlock()
+	item, ok := th.lookup(c, id)
+	if !ok {
+		c.String(http.StatusNotFound, `Not found: Item with id "%v"`, id)
+		return
+	}
+	if !th.checkPut(c, item, putItem) {
+		return
+	}
+	c.JSON(http.StatusOK, UpdatePreview{Changes: diffItems(item, applyPut(item, putItem))})
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Two items are duplicates if their names only differ in case and whitespace.
+func normalizeName(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), " "))
+}
+
+// Groups all items by their normalized name and returns the groups with more than one item. Each group is sorted by id and the
+// groups are sorted by their first id. Only the items visible to the request are grouped, so the items of two users are never
+// merged. The caller needs to hold the lock.
+func (th *TodoHandler) duplicateGroups(c *gin.Context) []TodoItemCollection {
+	byName := map[string]TodoItemCollection{}
+	for _, item := range th.visibleItems(c) {
+		name := normalizeName(item.Name)
+		byName[name] = append(byName[name], item)
+	}
+	groups := []TodoItemCollection{}
+	for _, group := range byName {
+		if len(group) > 1 {
+			sort.Sort(group)
+			groups = append(groups, group)
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i][0].Id < groups[j][0].Id })
+	return groups
+}
+
+func (th *TodoHandler) GetDuplicates(c *gin.Context) {
+	th.RLock()
+	defer th.RUnlock()
+	c.JSON(http.StatusOK, th.duplicateGroups(c))
+}
+
+// The result of the MergeDuplicates function. Merged is the number of items which were merged away.
+type MergeResult struct {
+	Merged int
+}
+
+// Merges every group of duplicates into its oldest item, which is the one with the lowest id, so its Id and CreatedAt are kept.
+// The survivor takes over the dependencies and tags of the others, and items depending on one of the others depend on the
+// survivor instead. Tags are taken over in the order of the ids until the survivor has maxTags of them, the rest is dropped.
+// The survivor is only complete if all items of its group are, so open work never disappears in a completed item.
+func (th *TodoHandler) MergeDuplicates(c *gin.Context) {
+	th.Lock()
+	defer th.Unlock()
+	result := MergeResult{}
+	for _, group := range th.duplicateGroups(c) {
+		// Merging an earlier group may have changed the dependencies of this one, so we need the current versions
+		for i := range group {
+			group[i] = th.items[group[i].Id]
+		}
+		survivor := group[0]
+		merged := map[int]bool{}
+		for _, item := range group[1:] {
+			merged[item.Id] = true
+			delete(th.items, item.Id)
+		}
+
+		// Point everything which depended on a merged item to the survivor. If the survivor already depends on the item this would
+		// create a cycle, so the item just loses the dependency in this case.
+		for id, item := range th.items {
+			if id == survivor.Id {
+				continue
+			}
+			redirect := !th.reaches(th.items[survivor.Id].DependsOn, id)
+			if deps, changed := replaceDependencies(item.DependsOn, merged, survivor.Id, redirect); changed {
+				item.DependsOn = deps
+				th.items[id] = item
+			}
+		}
+
+		// Take over the dependencies of the merged items, unless they would lead back to the survivor. A dependency of the survivor
+		// on one of its duplicates is dropped, as an item can't depend on itself.
+		survivor = th.items[survivor.Id]
+		deps, _ := replaceDependencies(survivor.DependsOn, merged, survivor.Id, false)
+		for _, item := range group[1:] {
+			if survivor.EstimateMinutes == nil {
+				survivor.EstimateMinutes = item.EstimateMinutes
+			}
+			if survivor.DueDate == nil {
+				survivor.DueDate = item.DueDate
+			}
+			if !item.IsComplete {
+				survivor.IsComplete = false
+			}
+			for _, tag := range item.Tags {
+				if len(survivor.Tags) < maxTags && !containsString(survivor.Tags, tag) {
+					survivor.Tags = append(survivor.Tags, tag)
+				}
+			}
+			for _, dep := range item.DependsOn {
+				if !merged[dep] && dep != survivor.Id && !containsInt(deps, dep) && !th.reaches([]int{dep}, survivor.Id) {
+					deps = append(deps, dep)
+				}
+			}
+		}
+		survivor.DependsOn = deps
+		th.items[survivor.Id] = th.touch(survivor)
+		result.Merged += len(group) - 1
+	}
+	if result.Merged > 0 && !th.saveOrFail(c) {
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// Replaces all ids of the given set with the target id, without adding the target twice. If redirect is false the ids are
+// removed instead. Returns a new slice and whether anything changed.
+func replaceDependencies(deps []int, replace map[int]bool, target int, redirect bool) ([]int, bool) {
+	changed := false
+	result := []int{}
+	for _, dep := range deps {
+		if replace[dep] {
+			changed = true
+			if !redirect {
+				continue
+			}
+			dep = target
+		}
+		if containsInt(result, dep) {
+			continue
+		}
+		result = append(result, dep)
+	}
+	if len(result) == 0 {
+		result = nil
+	}
+	return result, changed
+}
+
+func containsInt(list []int, value int) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Every item has a Version which goes up with each saved change. Its ETag is built from it, so clients can send it back with
+// If-Match and we can tell whether the item changed since they read it. Without this two clients editing the same item would
+// silently overwrite each other.
+
+// The ETag of a single item.
+func itemETag(item TodoItem) string {
+	return fmt.Sprintf(`"%v"`, item.Version)
+}
+
+// Reports whether the ETag is one of the comma separated tags in the header, or the header is "*". Weak tags are compared
+// without their W/ prefix, see RFC 7232 section 2.3.2.
+func etagListMatches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks the If-Match header of a request changing the item. Without the header the change is always allowed. On failure a 412 is
+// already written and false is returned.
+func checkIfMatch(c *gin.Context, item TodoItem) bool {
+	header := c.GetHeader("If-Match")
+	if header == "" {
+		return true
+	}
+	// If-Match needs the strong comparison, so a weak tag never matches
+	for _, tag := range strings.Split(header, ",") {
+		if tag = strings.TrimSpace(tag); tag == "*" || tag == itemETag(item) {
+			return true
+		}
+	}
+	c.Header("ETag", itemETag(item))
+	c.String(http.StatusPreconditionFailed, `Precondition failed: Item with id "%v" was changed, fetch it again`, item.Id)
+	return false
+}
+
+// Sets the ETag header and reports whether the client already has this version according to If-None-Match. In this case a 304
+// without a body is already written.
+func notModified(c *gin.Context, etag string) bool {
+	c.Header("ETag", etag)
+	if header := c.GetHeader("If-None-Match"); header != "" && etagListMatches(header, etag) {
+		c.Status(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// Reports whether the client already has this version according to If-Modified-Since. In this case a 304 without a body is
+// already written. The date is ignored if If-None-Match is sent, as the ETag is more precise, see RFC 7232 section 3.3. Dates
+// only have seconds, so a change within the same second as the date of the client goes unnoticed.
+func notModifiedSince(c *gin.Context, modified time.Time) bool {
+	if c.GetHeader("If-None-Match") != "" {
+		return false
+	}
+	since, err := http.ParseTime(c.GetHeader("If-Modified-Since"))
+	if err != nil || modified.Truncate(time.Second).After(since) {
+		return false
+	}
+	c.Status(http.StatusNotModified)
+	return true
+}
+
+// Writes the object as JSON with an ETag built from a hash of the body. Used for lists, which have no version of their own.
+// The tag is weak, as the same items may be serialized with other whitespace by another version of the service.
+func writeJSONWithETag(c *gin.Context, obj interface{}) {
+	body, err := json.Marshal(obj)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Internal server error: Serializing the response failed")
+		return
+	}
+	sum := sha256.Sum256(body)
+	if notModified(c, `W/"`+hex.EncodeToString(sum[:16])+`"`) {
+		return
+	}
+	c.Data(http.StatusOK, "application/json; charset=utf-8", body)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+)
+
+// Clients can follow all changes of the list live using Server-Sent Events at /api/TodoItems/events instead of polling it.
+// Every save publishes one event per created, updated or deleted item to the event bus, and the bus hands them to all
+// connected clients. The last events are kept, so a client which reconnects with the Last-Event-ID header gets everything it
+// missed in the meantime.
+
+// The types of events.
+const (
+	EventCreated = "created"
+	EventUpdated = "updated"
+	EventDeleted = "deleted"
+	// Sent instead of the missed events if they are not kept anymore. The client has to fetch the whole list again.
+	EventReset = "reset"
+)
+
+// A change of one item. For deleted items Item is the last version before the delete.
+type Event struct {
+	Id   int64
+	Type string
+	Item TodoItem
+	Time time.Time
+}
+
+// How many events are kept for clients which reconnect, and how many events a client may fall behind before it's disconnected.
+const (
+	eventHistorySize = 1000
+	eventBufferSize  = 64
+)
+
+// EventBus hands published events to all subscribers and keeps the last events for clients which reconnect.
+type EventBus struct {
+	lastID      int64
+	history     []Event
+	subscribers map[chan Event]bool
+	sync.Mutex
+}
+
+// The ids start at the current time in nanoseconds instead of 0. This way ids from before a restart are always older than the
+// new ones, and a client which reconnects after a restart gets a reset instead of the wrong events.
+func NewEventBus() *EventBus {
+	return &EventBus{lastID: time.Now().UnixNano(), subscribers: map[chan Event]bool{}}
+}
+
+// Assigns the next ids to the events and sends them to all subscribers. It never blocks: a subscriber which doesn't keep up is
+// disconnected, and its client can resume from the history with the id of the last event it got.
+func (b *EventBus) Publish(events ...Event) {
+	b.Lock()
+	defer b.Unlock()
+	for _, event := range events {
+		b.lastID++
+		event.Id = b.lastID
+		b.history = append(b.history, event)
+		for ch := range b.subscribers {
+			select {
+			case ch <- event:
+			default:
+				delete(b.subscribers, ch)
+				close(ch)
+			}
+		}
+	}
+	if len(b.history) > eventHistorySize {
+		b.history = append([]Event(nil), b.history[len(b.history)-eventHistorySize:]...)
+	}
+}
+
+// Ends all subscriptions, which ends the event streams of all clients. Used on shutdown.
+func (b *EventBus) Close() {
+	b.Lock()
+	defer b.Unlock()
+	for ch := range b.subscribers {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+}
+
+// Subscribes to all events after the given id. It returns the already published events the client missed, the channel for the
+// following ones and a function to unsubscribe. complete is false if some of the missed events are not kept anymore, which
+// also happens if the id is from before a restart. An id of 0 means the client doesn't want any old events.
+func (b *EventBus) Subscribe(lastID int64) (missed []Event, complete bool, events <-chan Event, cancel func()) {
+	b.Lock()
+	defer b.Unlock()
+	complete = true
+	if lastID > 0 {
+		oldest := b.lastID + 1
+		if len(b.history) > 0 {
+			oldest = b.history[0].Id
+		}
+		complete = lastID >= oldest-1 && lastID <= b.lastID
+		for _, event := range b.history {
+			if event.Id > lastID {
+				missed = append(missed, event)
+			}
+		}
+	}
+	ch := make(chan Event, eventBufferSize)
+	b.subscribers[ch] = true
+	return missed, complete, ch, func() {
+		b.Lock()
+		defer b.Unlock()
+		if b.subscribers[ch] {
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// Streams the events as Server-Sent Events. A comment is sent every 15 seconds, so proxies don't close an idle connection.
+func (th *TodoHandler) Events(c *gin.Context) {
+	// Browsers send the Last-Event-ID header on their own when they reconnect. The query parameter is for the first connect.
+	raw := c.GetHeader("Last-Event-ID")
+	if raw == "" {
+		raw = c.Query("lastEventId")
+	}
+	var lastID int64
+	if raw != "" {
+		var err error
+		if lastID, err = strconv.ParseInt(raw, 10, 64); err != nil || lastID < 0 {
+			c.String(http.StatusBadRequest, "Bad request: Last-Event-ID must be the id of an event")
+			return
+		}
+	}
+
+	missed, complete, events, cancel := th.events.Subscribe(lastID)
+	defer cancel()
+	c.Header("Cache-Control", "no-cache")
+	// Tells nginx not to buffer the stream
+	c.Header("X-Accel-Buffering", "no")
+	send := func(event Event) {
+		if visible(c, event.Item) {
+			c.Render(-1, sse.Event{Id: strconv.FormatInt(event.Id, 10), Event: event.Type, Data: event})
+		}
+	}
+	if !complete {
+		// The client fetches the whole list anyway, so the events we still have would only be sent twice
+		c.Render(-1, sse.Event{Event: EventReset, Data: gin.H{"Message": "Some events were missed, fetch the list again"}})
+	} else {
+		for _, event := range missed {
+			send(event)
+		}
+	}
+	c.Writer.Flush()
+
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case event, ok := <-events:
+			if !ok {
+				return false
+			}
+			send(event)
+		case <-keepAlive.C:
+			io.WriteString(w, ": keep-alive\n\n")
+		}
+		return true
+	})
+}
+
+// Turns the difference between the saved and the current items into events, ordered by id. The caller needs to hold the lock.
+func (th *TodoHandler) changeEvents() []Event {
+	events := []Event{}
+	now := th.clock.Now()
+	for _, item := range th.items {
+		if old, ok := th.saved[item.Id]; !ok {
+			events = append(events, Event{Type: EventCreated, Item: item, Time: now})
+		} else if len(diffItems(old, item)) > 0 {
+			events = append(events, Event{Type: EventUpdated, Item: item, Time: now})
+		}
+	}
+	for id, item := range th.saved {
+		if _, ok := th.items[id]; !ok {
+			events = append(events, Event{Type: EventDeleted, Item: item, Time: now})
+		}
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Item.Id < events[j].Item.Id })
+	return events
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Reads the field selection of the response and returns the TodoItem fields which should be left out. ?fields= is a comma separated
+// list of the fields to include, ?excludeFields= a list of the fields to leave out, and only one of them may be used. Field names
+// are case insensitive. The Id is always included and can never be excluded. On failure the response is already written and false
+// is returned.
+func parseExcludeFields(c *gin.Context) (map[string]bool, bool) {
+	include, exclude := c.Query("fields"), c.Query("excludeFields")
+	if include != "" && exclude != "" {
+		c.String(http.StatusBadRequest, "Bad request: fields and excludeFields can't be combined")
+		return nil, false
+	}
+	if include != "" {
+		names, ok := parseFieldNames(c, "fields", include)
+		if !ok {
+			return nil, false
+		}
+		itemType := reflect.TypeOf(TodoItem{})
+		excluded := map[string]bool{}
+		for i := 0; i < itemType.NumField(); i++ {
+			if name := itemType.Field(i).Name; name != "Id" && !names[name] {
+				excluded[name] = true
+			}
+		}
+		return excluded, true
+	}
+	if exclude == "" {
+		return nil, true
+	}
+	excluded, ok := parseFieldNames(c, "excludeFields", exclude)
+	if !ok {
+		return nil, false
+	}
+	if excluded["Id"] {
+		c.String(http.StatusBadRequest, "Bad request: Id cannot be excluded")
+		return nil, false
+	}
+	return excluded, true
+}
+
+// Turns a comma separated list of field names into the names of the TodoItem fields. On failure the response is already written
+// and false is returned.
+func parseFieldNames(c *gin.Context, param, raw string) (map[string]bool, bool) {
+	itemType := reflect.TypeOf(TodoItem{})
+	names := map[string]bool{}
+	for _, name := range strings.Split(raw, ",") {
+		field, ok := itemType.FieldByNameFunc(func(n string) bool { return strings.EqualFold(n, strings.TrimSpace(name)) })
+		if !ok {
+			c.String(http.StatusBadRequest, `Bad request: Unknown field "%v" in %v`, name, param)
+			return nil, false
+		}
+		names[field.Name] = true
+	}
+	return names, true
+}
+
+// Turns the item into a map with all fields except the excluded ones. Gin serializes the map just like the struct.
+func excludeFields(item TodoItem, exclude map[string]bool) map[string]interface{} {
+	value := reflect.ValueOf(item)
+	result := map[string]interface{}{}
+	for i := 0; i < value.NumField(); i++ {
+		name := value.Type().Field(i).Name
+		if !exclude[name] {
+			result[name] = value.Field(i).Interface()
+		}
+	}
+	return result
+}
+
+// Returns the items ready to be serialized, leaving out the excluded fields if there are any.
+func projectItems(items TodoItemCollection, exclude map[string]bool) interface{} {
+	if len(exclude) == 0 {
+		return items
+	}
+	result := make([]map[string]interface{}, len(items))
+	for i, item := range items {
+		result[i] = excludeFields(item, exclude)
+	}
+	return result
+}
+
+// Writes the items as JSON, leaving out the excluded fields if there are any. Pollers can send the ETag back with If-None-Match
+// to get a 304 as long as nothing changed.
+func writeItems(c *gin.Context, items TodoItemCollection, exclude map[string]bool) {
+	writeJSONWithETag(c, projectItems(items, exclude))
+}
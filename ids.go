@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// An IDParser turns the :id part of a url into the numeric id of an item. Functions are values in Go, so we can simply store the
+// parser we want to use inside of the TodoHandler and swap it depending on the configuration.
+type IDParser func(raw string) (int, error)
+
+var errInvalidID = errors.New("invalid id")
+
+// Plain decimal ids like "42". This is the default.
+func parseDecimalID(raw string) (int, error) {
+	id, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, errInvalidID
+	}
+	return id, nil
+}
+
+// Hexadecimal ids like "0x2a" or just "2a".
+func parseHexID(raw string) (int, error) {
+	raw = strings.TrimPrefix(strings.TrimPrefix(raw, "0x"), "0X")
+	id, err := strconv.ParseInt(raw, 16, 0)
+	if err != nil || raw == "" {
+		return 0, errInvalidID
+	}
+	return int(id), nil
+}
+
+// Returns a parser for ids with a fixed prefix like "TODO-42". The numeric part after the prefix is decimal.
+func prefixedIDParser(prefix string) IDParser {
+	return func(raw string) (int, error) {
+		if !strings.HasPrefix(raw, prefix) {
+			return 0, errInvalidID
+		}
+		return parseDecimalID(raw[len(prefix):])
+	}
+}
+
+// An IDFormatter is the opposite of an IDParser and turns an id into its url form, e.g. for the Location header.
+type IDFormatter func(id int) string
+
+// NewIDFormatter returns the formatter matching NewIDParser for the same format and prefix.
+func NewIDFormatter(format, prefix string) IDFormatter {
+	switch format {
+	case "hex":
+		return func(id int) string { return "0x" + strconv.FormatInt(int64(id), 16) }
+	case "prefixed":
+		return func(id int) string { return prefix + strconv.Itoa(id) }
+	}
+	return strconv.Itoa
+}
+
+// NewIDParser returns the parser for one of the supported formats "decimal", "hex" or "prefixed". An empty format means decimal.
+func NewIDParser(format, prefix string) (IDParser, error) {
+	switch format {
+	case "", "decimal":
+		return parseDecimalID, nil
+	case "hex":
+		return parseHexID, nil
+	case "prefixed":
+		if prefix == "" {
+			return nil, errors.New("the prefixed id format requires a prefix")
+		}
+		return prefixedIDParser(prefix), nil
+	}
+	return nil, fmt.Errorf("unknown id format %q", format)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+// Deserializes the JSON body into obj like c.ShouldBindJSON does. If lenient parsing is switched on and the body is not valid
+// JSON, we retry after removing comments and trailing commas, which some clients like to send.
+func (th *TodoHandler) bindJSON(c *gin.Context, obj interface{}) error {
+	body, err := c.GetRawData()
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(body, obj)
+	if err != nil && th.lenientJSON {
+		if relaxedErr := json.Unmarshal(relaxJSON(body), obj); relaxedErr == nil {
+			log.Printf("Lenient JSON parsing salvaged the body of %v %v: %v", c.Request.Method, c.Request.URL.Path, err)
+			err = nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+	// Run the validation of the binding tags, just as Gin would do
+	return binding.Validator.ValidateStruct(obj)
+}
+
+// Removes // and /* */ comments and trailing commas in objects and arrays from the JSON data. Everything inside of strings
+// stays untouched.
+func relaxJSON(data []byte) []byte {
+	return removeTrailingCommas(removeComments(data))
+}
+
+func removeComments(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	inString := false
+	for i := 0; i < len(data); i++ {
+		ch := data[i]
+		if inString {
+			out = append(out, ch)
+			if ch == '\\' && i+1 < len(data) {
+				i++
+				out = append(out, data[i])
+			} else if ch == '"' {
+				inString = false
+			}
+			continue
+		}
+		switch {
+		case ch == '"':
+			inString = true
+			out = append(out, ch)
+		case ch == '/' && i+1 < len(data) && data[i+1] == '/':
+			for i < len(data) && data[i] != '\n' {
+				i++
+			}
+			if i < len(data) {
+				out = append(out, '\n')
+			}
+		case ch == '/' && i+1 < len(data) && data[i+1] == '*':
+			end := bytes.Index(data[i+2:], []byte("*/"))
+			if end < 0 {
+				return out
+			}
+			i += end + 3
+			// Keep a space so comments between two tokens don't glue them together
+			out = append(out, ' ')
+		default:
+			out = append(out, ch)
+		}
+	}
+	return out
+}
+
+func removeTrailingCommas(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	inString := false
+	for i := 0; i < len(data); i++ {
+		ch := data[i]
+		if inString {
+			out = append(out, ch)
+			if ch == '\\' && i+1 < len(data) {
+				i++
+				out = append(out, data[i])
+			} else if ch == '"' {
+				inString = false
+			}
+			continue
+		}
+		if ch == '"' {
+			inString = true
+		}
+		if ch == ',' {
+			next := i + 1
+			for next < len(data) && (data[next] == ' ' || data[next] == '\t' || data[next] == '\n' || data[next] == '\r') {
+				next++
+			}
+			if next < len(data) && (data[next] == '}' || data[next] == ']') {
+				continue
+			}
+		}
+		out = append(out, ch)
+	}
+	return out
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// How the list gets sorted. By is the field and Desc flips the order. Items with the same value are always ordered by id.
+type sortOrder struct {
+	By   string
+	Desc bool
+}
+
+// Reads the ?sort and ?order query parameters. Lists are sorted by id in ascending order by default.
+// On failure the response is already written and false is returned.
+func parseSort(c *gin.Context) (sortOrder, bool) {
+	order := sortOrder{By: c.DefaultQuery("sort", "id")}
+	switch order.By {
+	case "id", "name", "position", "createdAt", "dueDate", "priority":
+	default:
+		c.String(http.StatusBadRequest, `Bad request: sort must be "id", "name", "position", "createdAt", "dueDate" or "priority"`)
+		return order, false
+	}
+	switch c.DefaultQuery("order", "asc") {
+	case "asc":
+	case "desc":
+		order.Desc = true
+	default:
+		c.String(http.StatusBadRequest, `Bad request: order must be "asc" or "desc"`)
+		return order, false
+	}
+	return order, true
+}
+
+func sortItems(items TodoItemCollection, order sortOrder) {
+	// Returns -1, 0 or 1 like strings.Compare, so we can flip the result for a descending order
+	compare := func(a, b TodoItem) int {
+		switch order.By {
+		case "name":
+			return strings.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name))
+		case "position":
+			if a.Position != b.Position {
+				if a.Position < b.Position {
+					return -1
+				}
+				return 1
+			}
+		case "createdAt":
+			return compareTimes(a.CreatedAt, b.CreatedAt)
+		case "dueDate":
+			// Items without a due date come last in ascending order, as they are the least urgent
+			switch {
+			case a.DueDate == nil && b.DueDate == nil:
+				return 0
+			case a.DueDate == nil:
+				return 1
+			case b.DueDate == nil:
+				return -1
+			}
+			return compareTimes(*a.DueDate, *b.DueDate)
+		case "priority":
+			return priorityRank(a.Priority) - priorityRank(b.Priority)
+		}
+		return 0
+	}
+	sort.Slice(items, func(i, j int) bool {
+		result := compare(items[i], items[j])
+		if result == 0 {
+			if order.By == "id" && order.Desc {
+				return items[i].Id > items[j].Id
+			}
+			return items[i].Id < items[j].Id
+		}
+		if order.Desc {
+			return result > 0
+		}
+		return result < 0
+	})
+}
+
+func compareTimes(a, b time.Time) int {
+	switch {
+	case a.Before(b):
+		return -1
+	case a.After(b):
+		return 1
+	}
+	return 0
+}
+
+// Position of the priority in the priorities list. Items stored before there were priorities have the default one.
+func priorityRank(priority string) int {
+	if priority == "" {
+		priority = defaultPriority
+	}
+	for i, p := range priorities {
+		if p == priority {
+			return i
+		}
+	}
+	return 0
+}
+
+// The filters of the list. A nil completed or overdue means both values match. An item has to carry all tags to match.
+type itemFilter struct {
+	completed *bool
+	overdue   *bool
+	query     string
+	tags      []string
+	// The time overdue is checked against
+	now time.Time
+}
+
+// Reads the filter query parameters ?completed= (or ?isComplete=), ?overdue=, ?tag= which can be repeated and ?q=, a case
+// insensitive search in the name. On failure the response is already written and false is returned.
+func parseFilter(c *gin.Context, now time.Time) (itemFilter, bool) {
+	filter := itemFilter{query: strings.ToLower(c.Query("q")), now: now}
+	for _, name := range []string{"completed", "isComplete", "overdue"} {
+		if raw, ok := c.GetQuery(name); ok {
+			b, err := strconv.ParseBool(raw)
+			if err != nil {
+				c.String(http.StatusBadRequest, "Bad request: %v must be true or false", name)
+				return filter, false
+			}
+			if name == "overdue" {
+				filter.overdue = &b
+			} else {
+				filter.completed = &b
+			}
+		}
+	}
+	for _, tag := range c.QueryArray("tag") {
+		filter.tags = append(filter.tags, strings.ToLower(strings.TrimSpace(tag)))
+	}
+	return filter, true
+}
+
+func (f itemFilter) matches(item TodoItem) bool {
+	if f.completed != nil && item.IsComplete != *f.completed {
+		return false
+	}
+	if f.overdue != nil && item.overdue(f.now) != *f.overdue {
+		return false
+	}
+	for _, tag := range f.tags {
+		if !containsString(item.Tags, tag) {
+			return false
+		}
+	}
+	return f.query == "" || strings.Contains(strings.ToLower(item.Name), f.query)
+}
+
+// An item is overdue if it isn't completed and its due date has passed.
+func (item TodoItem) overdue(now time.Time) bool {
+	return !item.IsComplete && item.DueDate != nil && item.DueDate.Before(now)
+}
+
+func containsString(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Reads an optional query parameter which has to be a number >= 0. If it's missing the default value is returned.
+// On failure the response is already written and false is returned.
+func parseNonNegative(c *gin.Context, name string, defaultValue int) (int, bool) {
+	raw, ok := c.GetQuery(name)
+	if !ok {
+		return defaultValue, true
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 0 {
+		c.String(http.StatusBadRequest, "Bad request: %v must be a number greater or equal to 0", name)
+		return 0, false
+	}
+	return n, true
+}
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// One page of the list, returned if ?page= or ?pageSize= is used. Next and Prev are links to the neighbour pages, or null if
+// there is no such page.
+type ItemPage struct {
+	Items    interface{}
+	Total    int
+	Page     int
+	PageSize int
+	Next     *string
+	Prev     *string
+}
+
+// Reads ?page= and ?pageSize=. Returns false for a 0 page if neither is set, as the list is then returned as a plain array.
+// On failure the response is already written and false is returned in the last value.
+func parsePage(c *gin.Context) (int, int, bool, bool) {
+	_, hasPage := c.GetQuery("page")
+	_, hasPageSize := c.GetQuery("pageSize")
+	if !hasPage && !hasPageSize {
+		return 0, 0, false, true
+	}
+	if _, ok := c.GetQuery("offset"); ok {
+		c.String(http.StatusBadRequest, "Bad request: page and pageSize can't be combined with offset and limit")
+		return 0, 0, false, false
+	}
+	if _, ok := c.GetQuery("limit"); ok {
+		c.String(http.StatusBadRequest, "Bad request: page and pageSize can't be combined with offset and limit")
+		return 0, 0, false, false
+	}
+	page, ok := parseNonNegative(c, "page", 1)
+	if !ok {
+		return 0, 0, false, false
+	}
+	pageSize, ok := parseNonNegative(c, "pageSize", defaultPageSize)
+	if !ok {
+		return 0, 0, false, false
+	}
+	if page < 1 || pageSize < 1 || pageSize > maxPageSize {
+		c.String(http.StatusBadRequest, "Bad request: page must be at least 1 and pageSize between 1 and %v", maxPageSize)
+		return 0, 0, false, false
+	}
+	return page, pageSize, true, true
+}
+
+// Builds the link to another page of the current request, keeping all other query parameters.
+func pageLink(c *gin.Context, page int) *string {
+	query := c.Request.URL.Query()
+	query.Set("page", strconv.Itoa(page))
+	link := c.Request.URL.Path + "?" + query.Encode()
+	return &link
+}
+
+// Cuts one page out of the sorted items and wraps it with the total count and the links to the neighbour pages.
+func paginate(c *gin.Context, items TodoItemCollection, page, pageSize int, exclude map[string]bool) ItemPage {
+	result := ItemPage{Total: len(items), Page: page, PageSize: pageSize}
+	start := (page - 1) * pageSize
+	if start > len(items) {
+		start = len(items)
+	}
+	end := start + pageSize
+	if end > len(items) {
+		end = len(items)
+	}
+	result.Items = projectItems(items[start:end], exclude)
+	if end < len(items) {
+		result.Next = pageLink(c, page+1)
+	}
+	if page > 1 {
+		// Point to the last existing page if the client went past the end
+		prev := page - 1
+		if last := (len(items) + pageSize - 1) / pageSize; prev > last {
+			prev = last
+		}
+		if prev >= 1 {
+			result.Prev = pageLink(c, prev)
+		}
+	}
+	return result
+}
@@ -1,31 +1,146 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"io"
+	"log"
 	"net/http"
-	"sort"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
+// The version of the API. Set it at build time with go build -ldflags "-X main.version=1.2.3" or at runtime using TODO_API_VERSION.
+var version = "dev"
+
 // Go's entrance function. Always named "main" in the "main" package.
 func main() {
+	cfg, err := LoadConfig()
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	version = cfg.APIVersion
+
 	// Create a instance of our ToDo controller to pass the different functions to the Gin router as seen a few lines below.
-	th := NewTodoHandler(0)
+	store, err := NewStore(cfg)
+	if err != nil {
+		log.Fatalf("Opening the store failed: %v", err)
+	}
+	th, err := NewTodoHandler(0, store)
+	if err != nil {
+		log.Fatalf("Loading the items failed: %v", err)
+	}
+	if err := cfg.Apply(&th); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
 
-	// Gin is our web api framework
-	r := gin.Default()
+	// Gin is our web api framework. Instead of gin.Default() we pick the middlewares ourselves, to log requests as JSON.
+	if cfg.GinMode != "" {
+		gin.SetMode(cfg.GinMode)
+	}
+	var tracing []gin.HandlerFunc
+	if cfg.Tracing {
+		var shutdown func(context.Context) error
+		tracing, shutdown, err = NewTracing(cfg.ServiceName)
+		if err != nil {
+			log.Fatalf("Setting up tracing failed: %v", err)
+		}
+		// Send the spans which are still buffered before we exit
+		defer shutdown(context.Background())
+	}
+	r, err := NewRouter(cfg, &th, store, tracing)
+	if err != nil {
+		log.Fatalf("Setting up the routes failed: %v", err)
+	}
+
+	// listen and serve on 0.0.0.0:8080 (for windows "localhost:8080") unless another address is configured
+	if err := serve(cfg, r, th.events.Close); err != nil {
+		log.Fatalf("Server failed: %v", err)
+	}
+	// Every change is saved right away, so there is nothing left to write. We only close the database connection.
+	if closer, ok := store.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Printf("Closing the store failed: %v", err)
+		}
+	}
+	log.Printf("Shutdown complete")
+}
+
+// Creates the Gin router with all middlewares and routes. The tracing middlewares are optional, see NewTracing.
+func NewRouter(cfg Config, th *TodoHandler, store TodoStore, tracing []gin.HandlerFunc) (*gin.Engine, error) {
+	r := gin.New()
+	// Gin trusts the X-Forwarded-For header of every client by default, so anyone could pick their own IP for the rate limit and
+	// the logs. We only trust the configured proxies.
+	if err := r.SetTrustedProxies(cfg.trustedProxies()); err != nil {
+		return nil, fmt.Errorf("TODO_TRUSTED_PROXIES is invalid: %v", err)
+	}
+	// The API version and the optional Server-Timing go first, so every response carries them, including the probes and the ones
+	// of the rate limit
+	r.Use(APIVersion(version), RequestID())
+	if cfg.ServerTiming {
+		r.Use(ServerTiming())
+	}
+	r.Use(tracing...)
+	r.Use(StructuredLogger(), gin.Recovery(), Metrics())
+	// Probes and metrics are registered before the rate limit, so Gin doesn't add it to them and the orchestrator is never limited
+	r.GET("/healthz", Healthz)
+	r.GET("/readyz", Readyz(store))
+	r.GET("/metrics", th.MetricsHandler())
+	if cfg.RateLimit > 0 {
+		r.Use(RateLimit(cfg.RateLimit, cfg.RateBurst))
+	}
 
 	// Register our routes
-	r.GET("/api/TodoItems", th.GetItems)
-	r.GET("/api/TodoItems/:id", th.GetItemByID)
-	r.POST("/api/TodoItems", th.PostItem)
-	r.PUT("/api/TodoItems/:id", th.PutItem)
-	r.DELETE("/api/TodoItems/:id", th.DeleteItem)
+	r.GET("/version", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"version": version})
+	})
+	// All item routes are grouped, so they share the token check if auth is switched on
+	items := r.Group("/api/TodoItems")
+	if cfg.Auth {
+		auth, err := NewAuth(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("loading the users failed: %v", err)
+		}
+		r.POST("/api/users/register", auth.Register)
+		r.POST("/api/users/login", auth.Login)
+		items.Use(auth.RequireToken())
+	}
+	items.GET("", th.GetItems)
+	items.GET("/eta", th.GetETA)
+	items.GET("/graph", th.GetGraph)
+	items.GET("/first-incomplete", th.GetFirstIncomplete)
+	items.GET("/duplicates", th.GetDuplicates)
+	items.GET("/export", th.Export)
+	items.GET("/events", th.Events)
+	items.GET("/:id", th.GetItemByID)
+	// HEAD requests use the same handlers as GET. Go's http server drops the body for HEAD requests but keeps all headers.
+	items.HEAD("", th.GetItems)
+	items.HEAD("/:id", th.GetItemByID)
+	items.POST("", th.PostItem)
+	items.POST("/ordered", th.GetOrderedItems)
+	items.POST("/find-replace", th.FindReplace)
+	items.POST("/plan", th.PlanSync)
+	items.POST("/sync", th.Sync)
+	items.POST("/merge-duplicates", th.MergeDuplicates)
+	items.POST("/bulk", th.Bulk)
+	items.POST("/import", th.Import)
+	items.PUT("/:id", th.PutItem)
+	items.PATCH("/:id", th.PatchItem)
+	items.DELETE("/:id", th.DeleteItem)
+	items.POST("/:id/move", th.MoveItem)
+	items.POST("/:id/toggle", th.ToggleItem)
+	items.POST("/:id/split", th.SplitItem)
+	items.POST("/:id/preview-update", th.PreviewUpdate)
+
+	// Admin routes are grouped, so they share the api key check
+	admin := r.Group("/api/admin", AdminAuth(cfg.AdminAPIKey))
+	admin.GET("/config", ConfigHandler(cfg))
+	admin.POST("/normalize-positions", th.NormalizePositions)
 
-	// listen and serve on 0.0.0.0:8080 (for windows "localhost:8080")
-	r.Run()
+	return r, nil
 }
 
 // Our TodoItem
@@ -33,6 +148,28 @@ type TodoItem struct {
 	Id         int
 	Name       string
 	IsComplete bool
+	// Optional effort estimate. A pointer so we can tell "no estimate" (nil) apart from an estimate of zero minutes.
+	EstimateMinutes *int
+	// Ids of the items which have to be done before this one.
+	DependsOn []int
+	// Sort key for a custom order of the list. See ordering.go for how it's assigned.
+	Position float64
+	// Optional date the item has to be done by. Incomplete items past this date are overdue.
+	DueDate *time.Time
+	// One of "low", "normal" or "high".
+	Priority string
+	// Free labels to group items, like "work" or "home". Always lower case.
+	Tags []string
+	// When the item was created and last changed. They are set by the server, clients cannot change them.
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	// When the item was completed. Set by the server when the item is completed and removed again when it's reopened.
+	CompletedAt *time.Time
+	// The user who created the item. Empty if auth is switched off, see auth.go.
+	Owner string
+	// Goes up with every saved change, except for positions changed by a rebalance. The ETag of the item is built from it, see
+	// etag.go and save.
+	Version int
 }
 
 // Create a custom TodoItem array (slice) with the three functions below type to make it sortable by id. One downside of Go: It has not generics, yet :(.
@@ -44,21 +181,53 @@ func (t TodoItemCollection) Less(i, j int) bool { return t[i].Id < t[j].Id }
 
 // Same as our TodoItem but without the id and isComplete because a new item doesn't have a id and is never directly completed.
 type PostTodoItem struct {
-	Name string
+	Name            string `binding:"required,max=200"`
+	EstimateMinutes *int
+	DependsOn       []int
+	DueDate         *time.Time
+	Priority        string
+	Tags            []string
 }
 
 // Same as our TodoItem but without the id because we cannot change the id of a item.
 type PutTodoItem struct {
-	Name       string
-	IsComplete bool
+	Name            string `binding:"required,max=200"`
+	IsComplete      bool
+	EstimateMinutes *int
+	DependsOn       []int
+	DueDate         *time.Time
+	Priority        string
+	Tags            []string
 }
 
 // Go has no classic constructors you create instances of structs by normal functions.
-func NewTodoHandler(lastID int) TodoHandler {
-	return TodoHandler{
-		items:  map[int]TodoItem{},
-		lastID: lastID,
+// All items are loaded from the store, and every change is saved back into it. See persistence.go for the available stores.
+func NewTodoHandler(lastID int, store TodoStore) (TodoHandler, error) {
+	list, err := store.List()
+	if err != nil {
+		return TodoHandler{}, err
 	}
+	items := make(map[int]TodoItem, len(list))
+	for _, item := range list {
+		items[item.Id] = item
+		// Continue counting after the highest id we know, otherwise we would hand out ids twice
+		if item.Id > lastID {
+			lastID = item.Id
+		}
+	}
+	return TodoHandler{
+		items:                   items,
+		saved:                   copyItems(items),
+		events:                  NewEventBus(),
+		lastID:                  lastID,
+		store:                   store,
+		productiveMinutesPerDay: 8 * 60,
+		parseID:                 parseDecimalID,
+		formatID:                strconv.Itoa,
+		clock:                   systemClock{},
+		allowReopen:             true,
+		softLimitPercent:        80,
+	}, nil
 }
 
 // This struct is like a class MVC controller. It also holds the state of the Todo items.
@@ -67,79 +236,297 @@ func NewTodoHandler(lastID int) TodoHandler {
 type TodoHandler struct {
 	items  map[int]TodoItem
 	lastID int
+	// Where the items are saved after every change, and the items as they were at the last save. See persistence.go.
+	store TodoStore
+	saved map[int]TodoItem
+	// Every saved change is published here, see events.go.
+	events *EventBus
+	// How many minutes of estimated work get done per day. Used to project the completion date of the list.
+	productiveMinutesPerDay int
+	// Converts the id in the url into a number. Depends on the configured id format.
+	parseID  IDParser
+	formatID IDFormatter
+	// If true an item can only be completed after all of its dependencies are completed.
+	blockOnIncompleteDependencies bool
+	// If true completed items are read only. Reopening them is still possible as long as allowReopen is true.
+	lockCompletedItems bool
+	allowReopen        bool
+	// Limits how many incomplete items can exist at the same time, like a WIP limit on a kanban board. 0 means no limit.
+	maxOpenItems int
+	// Percentage of maxOpenItems at which we start to warn clients about the limit. 0 turns the warning off.
+	softLimitPercent int
+	// If true request bodies with comments or trailing commas are accepted. See lenient.go.
+	lenientJSON bool
+	// If true a PUT which doesn't change anything skips the write and returns the stored item.
+	skipNoopUpdates bool
+	// Source of the current time for everything based on dates. See clock.go.
+	clock Clock
 	sync.RWMutex
 }
 
 // The variable c of type gin.Context handels all the http stuff for us. It contains all methods we need for getting data from the request
 // and out to the response. As seen below the JSON method writes out our map as JSON combined with a status code.
 func (th *TodoHandler) GetItems(c *gin.Context) {
+	order, ok := parseSort(c)
+	if !ok {
+		return
+	}
+	exclude, ok := parseExcludeFields(c)
+	if !ok {
+		return
+	}
+	filter, ok := parseFilter(c, th.clock.Now())
+	if !ok {
+		return
+	}
+	// With ?page= or ?pageSize= the result is wrapped into an ItemPage, otherwise it's a plain array
+	page, pageSize, paged, ok := parsePage(c)
+	if !ok {
+		return
+	}
+	offset, ok := parseNonNegative(c, "offset", 0)
+	if !ok {
+		return
+	}
+	// -1 means no limit
+	limit, ok := parseNonNegative(c, "limit", -1)
+	if !ok {
+		return
+	}
+	// Admins may look at the items of all users with ?all=true
+	all, err := strconv.ParseBool(c.DefaultQuery("all", "false"))
+	if err != nil {
+		c.String(http.StatusBadRequest, "Bad request: all must be true or false")
+		return
+	}
+	if user, ok := currentUser(c); all && ok && !user.Admin {
+		c.String(http.StatusForbidden, "Forbidden: Only admins can list the items of all users")
+		return
+	}
+
 	// Here we are just read locking the map to prevent data races.
 	th.RLock()
 	// Lets convert our map into a array (slice in golang) just the be the same as the .NET Core application API.
 	// We use a preallocated slice with the same capacity as the map to improve performance
-	items := make(TodoItemCollection, len(th.items))
-	i := 0
+	items := make(TodoItemCollection, 0, len(th.items))
 	for _, item := range th.items {
-		items[i] = item
-		i++
+		if filter.matches(item) && (all || visible(c, item)) {
+			items = append(items, item)
+		}
 	}
-	sort.Sort(items)
-	c.JSON(http.StatusOK, items)
 	th.RUnlock()
+	sortItems(items, order)
+	// The total count contains all matching items, so clients know how many pages there are
+	c.Header("X-Total-Count", strconv.Itoa(len(items)))
+	if paged {
+		writeJSONWithETag(c, paginate(c, items, page, pageSize, exclude))
+		return
+	}
+	if offset > len(items) {
+		offset = len(items)
+	}
+	items = items[offset:]
+	if limit >= 0 && limit < len(items) {
+		items = items[:limit]
+	}
+	writeItems(c, items, exclude)
+}
+
+// Returns the first incomplete item in the requested order, which is the next thing to work on. It takes the same filters as the
+// list, so ?tag=work returns the next thing to do at work.
+func (th *TodoHandler) GetFirstIncomplete(c *gin.Context) {
+	order, ok := parseSort(c)
+	if !ok {
+		return
+	}
+	filter, ok := parseFilter(c, th.clock.Now())
+	if !ok {
+		return
+	}
+
+	th.RLock()
+	defer th.RUnlock()
+	items := TodoItemCollection{}
+	for _, item := range th.visibleItems(c) {
+		if !item.IsComplete && filter.matches(item) {
+			items = append(items, item)
+		}
+	}
+	if len(items) == 0 {
+		c.String(http.StatusNotFound, "Not found: There are no incomplete items")
+		return
+	}
+	sortItems(items, order)
+	c.JSON(http.StatusOK, items[0])
+}
+
+// The body of a GetOrderedItems request.
+type OrderedItemsRequest struct {
+	Ids []int
+}
+
+// The result of the GetOrderedItems function. Missing lists the requested ids which don't exist.
+type OrderedItems struct {
+	Items   TodoItemCollection
+	Missing []int
+}
+
+// Returns the requested items in exactly the order of the ids in the body. It's a POST because the list of ids can get too long
+// for a url.
+func (th *TodoHandler) GetOrderedItems(c *gin.Context) {
+	request := OrderedItemsRequest{}
+	if err := th.bindJSON(c, &request); err != nil {
+		c.String(http.StatusBadRequest, "Bad request")
+		return
+	}
+
+	result := OrderedItems{Items: TodoItemCollection{}, Missing: []int{}}
+	th.RLock()
+	for _, id := range request.Ids {
+		if item, ok := th.lookup(c, id); ok {
+			result.Items = append(result.Items, item)
+		} else {
+			result.Missing = append(result.Missing, id)
+		}
+	}
+	th.RUnlock()
+	c.JSON(http.StatusOK, result)
 }
 
 func (th *TodoHandler) GetItemByID(c *gin.Context) {
 	// As url parameters are strings we first need to convert the string into a int
-	id, err := strconv.Atoi(c.Param("id"))
+	id, err := th.parseID(c.Param("id"))
 	if err != nil {
 		c.String(http.StatusBadRequest, "Bad request: Id in path is not a valid id")
 		return
 	}
+	exclude, ok := parseExcludeFields(c)
+	if !ok {
+		return
+	}
 
 	// Read locking to prevent data races
 	th.RLock()
-	item, ok := th.items[id]
+	item, ok := th.lookup(c, id)
 	if !ok {
 		c.String(http.StatusNotFound, `Not found: Item with id "%v"`, id)
 	} else {
-		c.JSON(http.StatusOK, item)
+		c.Header("Last-Modified", item.UpdatedAt.UTC().Format(http.TimeFormat))
+		if len(exclude) > 0 {
+			// Without some fields the body is not the item the version stands for, so it gets a tag of its own like the lists
+			if !notModifiedSince(c, item.UpdatedAt) {
+				writeJSONWithETag(c, excludeFields(item, exclude))
+			}
+		} else if !notModified(c, itemETag(item)) && !notModifiedSince(c, item.UpdatedAt) {
+			c.JSON(http.StatusOK, item)
+		}
 	}
 	th.RUnlock()
 }
 
 func (th *TodoHandler) PostItem(c *gin.Context) {
-	// Create a instance of our PostTodoItem because we need to pass a pointer of it to ShouldBindJSON.
+	// Create a instance of our PostTodoItem because we need to pass a pointer of it to bindJSON.
 	// Gin will then deserialize the JSON for us into this struct.
 	item := PostTodoItem{}
 	// Deserialize the JSON body into our item
-	err := c.ShouldBindJSON(&item)
+	err := th.bindJSON(c, &item)
 	if err != nil {
-		c.String(http.StatusBadRequest, "Bad request")
+		c.String(http.StatusBadRequest, bindErrorMessage(err))
+		return
+	}
+	// A new item is like a PUT of an incomplete item, so the same validation applies
+	putItem := item.putItem()
+	if err := validatePut(&putItem); err != nil {
+		c.String(http.StatusBadRequest, "Bad request: %v", err)
 		return
 	}
 
 	// Write locking cause we are going to write into the TodoHandler
 	th.Lock()
+	defer th.Unlock()
+	if th.maxOpenItems > 0 && th.openItems(ownerOf(c)) >= th.maxOpenItems {
+		c.String(http.StatusConflict, "Conflict: The limit of %v open items is reached, complete an item first", th.maxOpenItems)
+		return
+	}
+	if status, msg := th.createRules(ownerOf(c), putItem); status != 0 {
+		c.String(status, msg)
+		return
+	}
+	created := th.create(ownerOf(c), putItem)
+	th.ensureUniquePositions()
+	if !th.saveOrFail(c) {
+		return
+	}
+	th.warnOpenItemsLimit(c, th.openItems(ownerOf(c)))
+	// Tell the client where the new item lives and send it back, so there is no need to fetch it again.
+	c.Header("Location", "/api/TodoItems/"+th.formatID(created.Id))
+	c.Header("ETag", itemETag(th.items[created.Id]))
+	c.JSON(http.StatusCreated, th.items[created.Id])
+}
+
+// The PUT body for a new item. New items are never complete.
+func (item PostTodoItem) putItem() PutTodoItem {
+	return PutTodoItem{
+		Name:            item.Name,
+		EstimateMinutes: item.EstimateMinutes,
+		DependsOn:       item.DependsOn,
+		DueDate:         item.DueDate,
+		Priority:        item.Priority,
+		Tags:            item.Tags,
+	}
+}
+
+// Checks the rules which depend on the other items before a new item is created. It returns a 400 or 409 status and a message
+// if the item is invalid. The caller needs to hold the lock.
+func (th *TodoHandler) createRules(owner string, putItem PutTodoItem) (int, string) {
+	if err := th.checkDueDate(nil, putItem.DueDate); err != nil {
+		return http.StatusBadRequest, fmt.Sprintf("Bad request: %v", err)
+	}
+	// A new item cannot be part of a cycle yet, as nothing depends on it. We only need to check that the dependencies exist.
+	return th.checkDependencies(owner, th.lastID+1, putItem.DependsOn)
+}
+
+// Stores a new item at the end of the list and returns it. The caller needs to hold the write lock and to check the item first.
+func (th *TodoHandler) create(owner string, putItem PutTodoItem) TodoItem {
 	// Increment the id counter to fake real database id's.
 	th.lastID++
-	// Assign the
-	th.items[th.lastID] = TodoItem{
-		Id:         th.lastID,
-		Name:       item.Name,
-		IsComplete: false,
+	now := th.clock.Now()
+	item := applyPut(TodoItem{Id: th.lastID, Position: th.nextPosition(), CreatedAt: now, UpdatedAt: now, Owner: owner}, putItem)
+	item.CompletedAt = completedAt(item, now)
+	th.items[item.Id] = item
+	return item
+}
+
+// Adds a Warning header once the number of open items reaches the soft limit, so clients can react before they hit the hard limit.
+func (th *TodoHandler) warnOpenItemsLimit(c *gin.Context, open int) {
+	if th.maxOpenItems <= 0 || th.softLimitPercent <= 0 {
+		return
+	}
+	if open*100 >= th.maxOpenItems*th.softLimitPercent {
+		// 199 is the code for a miscellaneous warning. The dash stands for the unknown agent, see RFC 7234 section 5.5.
+		c.Header("Warning", fmt.Sprintf(`199 - "%v of %v open items used, the limit is almost reached"`, open, th.maxOpenItems))
+	}
+}
+
+// Counts the incomplete items of the owner. With auth every user has their own limit, otherwise all items have the empty owner
+// and share one. The caller needs to hold the lock.
+func (th *TodoHandler) openItems(owner string) int {
+	open := 0
+	for _, item := range th.items {
+		if !item.IsComplete && item.Owner == owner {
+			open++
+		}
 	}
-	th.Unlock()
+	return open
 }
 
 func (th *TodoHandler) PutItem(c *gin.Context) {
-	putItem := PutTodoItem{}
-	err := c.ShouldBindJSON(&putItem)
-	if err != nil {
-		c.String(http.StatusBadRequest, "Bad request")
+	putItem, ok := th.bindPutItem(c)
+	if !ok {
 		return
 	}
 
-	id, err := strconv.Atoi(c.Param("id"))
+	id, err := th.parseID(c.Param("id"))
 	if err != nil {
 		c.String(http.StatusBadRequest, "Bad request: Id in url is not a valid id")
 		return
@@ -149,31 +536,418 @@ func (th *TodoHandler) PutItem(c *gin.Context) {
 	// Defer calls the statement behind after the function has returned. We use defer here to make sure we unlock the map again.
 	// We can forget it inside of the early return, so its better to use defer to make sure we unlock it to prevent a deadlock.
 	defer th.Unlock()
-	item, ok := th.items[id]
+	item, ok := th.lookup(c, id)
 	if !ok {
 		c.String(http.StatusNotFound, `Not found: Item with id "%v"`, id)
 		return
 	}
-	// Tricky one liner :P. We assign Name and IsComplete from the put Item and after this we directly assign the modified item back to
-	// the map because Go supports multiple assignments in one line using commas.
-	item.Name, item.IsComplete, th.items[id] = putItem.Name, putItem.IsComplete, item
+	if !checkIfMatch(c, item) {
+		return
+	}
+	th.updateItem(c, item, putItem)
+}
+
+// Applies a PUT to a stored item and writes the response. Used by PutItem and PatchItem. The caller needs to hold the write lock.
+func (th *TodoHandler) updateItem(c *gin.Context, item TodoItem, putItem PutTodoItem) {
+	if !th.checkPut(c, item, putItem) || !th.checkReopen(c, item, putItem) {
+		return
+	}
+	updated := applyPut(item, putItem)
+	// Retried requests often send exactly what we already have. There is nothing to write in this case.
+	if th.skipNoopUpdates && len(diffItems(item, updated)) == 0 {
+		c.Header("X-No-Change", "true")
+		c.Header("ETag", itemETag(item))
+		c.JSON(http.StatusOK, item)
+		return
+	}
+	th.items[item.Id] = th.touch(updated)
+	if !th.saveOrFail(c) {
+		return
+	}
+	updated = th.items[item.Id]
+	c.Header("ETag", itemETag(updated))
+	c.JSON(http.StatusOK, updated)
+}
+
+// Same as PutTodoItem but every field is optional. Pointers are nil if the field is missing in the JSON, so we can tell "not sent"
+// apart from an empty value.
+type PatchTodoItem struct {
+	Name            *string `binding:"omitempty,max=200"`
+	IsComplete      *bool
+	EstimateMinutes *int
+	DependsOn       *[]int
+	DueDate         *time.Time
+	Priority        *string
+	Tags            *[]string
+}
+
+// Updates only the fields which are present in the body and leaves all others untouched.
+func (th *TodoHandler) PatchItem(c *gin.Context) {
+	patch := PatchTodoItem{}
+	err := th.bindJSON(c, &patch)
+	if err != nil {
+		c.String(http.StatusBadRequest, bindErrorMessage(err))
+		return
+	}
+	if patch.Name != nil {
+		name, err := validateName(*patch.Name)
+		if err != nil {
+			c.String(http.StatusBadRequest, "Bad request: %v", err)
+			return
+		}
+		patch.Name = &name
+	}
+	if patch.EstimateMinutes != nil && *patch.EstimateMinutes < 0 {
+		c.String(http.StatusBadRequest, "Bad request: EstimateMinutes must not be negative")
+		return
+	}
+	if patch.Priority != nil {
+		priority, err := validatePriority(*patch.Priority)
+		if err != nil {
+			c.String(http.StatusBadRequest, "Bad request: %v", err)
+			return
+		}
+		patch.Priority = &priority
+	}
+	if patch.Tags != nil {
+		tags, err := validateTags(*patch.Tags)
+		if err != nil {
+			c.String(http.StatusBadRequest, "Bad request: %v", err)
+			return
+		}
+		patch.Tags = &tags
+	}
+
+	id, err := th.parseID(c.Param("id"))
+	if err != nil {
+		c.String(http.StatusBadRequest, "Bad request: Id in url is not a valid id")
+		return
+	}
+
+	// The read of the current item and the write of the patched item have to happen under the same lock. Otherwise two PATCH
+	// requests could read the same version and the second write would undo the first one.
+	th.Lock()
+	defer th.Unlock()
+	item, ok := th.lookup(c, id)
+	if !ok {
+		c.String(http.StatusNotFound, `Not found: Item with id "%v"`, id)
+		return
+	}
+	if !checkIfMatch(c, item) {
+		return
+	}
+	// Start with the stored values and overwrite the ones which were sent
+	putItem := putFromItem(item)
+	if patch.Name != nil {
+		putItem.Name = *patch.Name
+	}
+	if patch.IsComplete != nil {
+		putItem.IsComplete = *patch.IsComplete
+	}
+	if patch.EstimateMinutes != nil {
+		putItem.EstimateMinutes = patch.EstimateMinutes
+	}
+	if patch.DependsOn != nil {
+		putItem.DependsOn = *patch.DependsOn
+	}
+	// A missing DueDate and "DueDate": null look the same after decoding, so PATCH can only set a due date. Use PUT to remove it.
+	if patch.DueDate != nil {
+		putItem.DueDate = patch.DueDate
+	}
+	if patch.Priority != nil {
+		putItem.Priority = *patch.Priority
+	}
+	if patch.Tags != nil {
+		putItem.Tags = *patch.Tags
+	}
+	th.updateItem(c, item, putItem)
+}
+
+// Deserializes and validates the body of a PUT request. On failure the response is already written and false is returned.
+func (th *TodoHandler) bindPutItem(c *gin.Context) (PutTodoItem, bool) {
+	putItem := PutTodoItem{}
+	err := th.bindJSON(c, &putItem)
+	if err != nil {
+		c.String(http.StatusBadRequest, bindErrorMessage(err))
+		return putItem, false
+	}
+	if err := validatePut(&putItem); err != nil {
+		c.String(http.StatusBadRequest, "Bad request: %v", err)
+		return putItem, false
+	}
+	return putItem, true
+}
+
+// Checks the rules which depend on the other items before a PUT is applied to the item. On failure the response is already
+// written and false is returned. The caller needs to hold the lock.
+func (th *TodoHandler) checkPut(c *gin.Context, item TodoItem, putItem PutTodoItem) bool {
+	if status, msg := th.putRules(item, putItem); status != 0 {
+		c.String(status, msg)
+		return false
+	}
+	return true
+}
+
+// Checks that reopening a completed item doesn't exceed the limit of open items, otherwise creating items as complete and
+// reopening them would get around it. On failure the response is already written and false is returned. The caller needs to
+// hold the lock.
+func (th *TodoHandler) checkReopen(c *gin.Context, item TodoItem, putItem PutTodoItem) bool {
+	if th.maxOpenItems <= 0 || !item.IsComplete || putItem.IsComplete {
+		return true
+	}
+	if th.openItems(item.Owner)+1 > th.maxOpenItems {
+		c.String(http.StatusConflict, "Conflict: The limit of %v open items is reached, complete an item first", th.maxOpenItems)
+		return false
+	}
+	return true
+}
+
+// Same as checkPut, but returns the status and the message instead of writing them, so requests changing many items can report
+// which item failed.
+func (th *TodoHandler) putRules(item TodoItem, putItem PutTodoItem) (int, string) {
+	if th.lockCompletedItems && item.IsComplete {
+		changes := diffItems(item, applyPut(item, putItem))
+		_, reopens := changes["IsComplete"]
+		// Reopening is the only edit allowed on a locked item, and only if no other field changes at the same time.
+		if len(changes) > 0 && !(len(changes) == 1 && reopens && th.allowReopen) {
+			return http.StatusLocked, fmt.Sprintf(`Locked: Item with id "%v" is completed and cannot be changed`, item.Id)
+		}
+	}
+	if err := th.checkDueDate(item.DueDate, putItem.DueDate); err != nil {
+		return http.StatusBadRequest, fmt.Sprintf("Bad request: %v", err)
+	}
+	if status, msg := th.checkDependencies(item.Owner, item.Id, putItem.DependsOn); status != 0 {
+		return status, msg
+	}
+	if th.blockOnIncompleteDependencies && putItem.IsComplete && !item.IsComplete {
+		if blocking := th.blockingDependencies(putItem.DependsOn); len(blocking) > 0 {
+			return http.StatusConflict, fmt.Sprintf(`Conflict: Item "%v" is blocked by the incomplete items %v`, item.Id, blocking)
+		}
+	}
+	return 0, ""
+}
+
+// Returns a PUT body which would leave the item as it is. Handlers which change single fields start with it.
+func putFromItem(item TodoItem) PutTodoItem {
+	return PutTodoItem{
+		Name:            item.Name,
+		IsComplete:      item.IsComplete,
+		EstimateMinutes: item.EstimateMinutes,
+		DependsOn:       item.DependsOn,
+		DueDate:         item.DueDate,
+		Priority:        item.Priority,
+		Tags:            item.Tags,
+	}
+}
+
+// Returns the item with all fields of the put item applied. As structs are values in Go, the item passed in stays untouched.
+func applyPut(item TodoItem, putItem PutTodoItem) TodoItem {
+	// We assign the fields from the put item in one line because Go supports multiple assignments using commas.
+	item.Name, item.IsComplete, item.EstimateMinutes = putItem.Name, putItem.IsComplete, putItem.EstimateMinutes
+	item.DependsOn = uniqueIDs(putItem.DependsOn)
+	item.DueDate, item.Priority, item.Tags = putItem.DueDate, putItem.Priority, putItem.Tags
+	// Don't distinguish between an empty list and no list, otherwise "DependsOn": [] would count as a change
+	if len(item.DependsOn) == 0 {
+		item.DependsOn = nil
+	}
+	if len(item.Tags) == 0 {
+		item.Tags = nil
+	}
+	return item
+}
+
+// Returns the item with UpdatedAt set to now and CompletedAt matching IsComplete. Every change a client asks for touches the item,
+// but side effects like removing the id of a deleted item from DependsOn don't.
+func (th *TodoHandler) touch(item TodoItem) TodoItem {
+	now := th.clock.Now()
+	item.UpdatedAt = now
+	item.CompletedAt = completedAt(item, now)
+	return item
+}
+
+// Returns the CompletedAt of the item: unchanged if it was already completed before, now if it was just completed and nil if
+// it's open.
+func completedAt(item TodoItem, now time.Time) *time.Time {
+	if !item.IsComplete {
+		return nil
+	}
+	if item.CompletedAt != nil {
+		return item.CompletedAt
+	}
+	return &now
+}
+
+// Flips IsComplete of an item and returns the updated item. This is the simplest way to implement a checkbox in a UI.
+func (th *TodoHandler) ToggleItem(c *gin.Context) {
+	id, err := th.parseID(c.Param("id"))
+	if err != nil {
+		c.String(http.StatusBadRequest, "Bad request: Id in url is not a valid id")
+		return
+	}
+
+	th.Lock()
+	defer th.Unlock()
+	item, ok := th.lookup(c, id)
+	if !ok {
+		c.String(http.StatusNotFound, `Not found: Item with id "%v"`, id)
+		return
+	}
+	if !checkIfMatch(c, item) {
+		return
+	}
+	// A toggle is just a PUT which only changes IsComplete, so the same rules apply.
+	putItem := putFromItem(item)
+	putItem.IsComplete = !item.IsComplete
+	if !th.checkPut(c, item, putItem) || !th.checkReopen(c, item, putItem) {
+		return
+	}
+	th.items[id] = th.touch(applyPut(item, putItem))
+	if !th.saveOrFail(c) {
+		return
+	}
+	item = th.items[id]
+	c.Header("ETag", itemETag(item))
+	c.JSON(http.StatusOK, item)
+}
+
+// The body of a split request. Every name becomes a new item.
+type SplitTodoItem struct {
+	Names []string
+}
+
+// Splits an item into several new items which inherit its dependencies. By default the source item is deleted afterwards.
+// With ?keepSource=true it's kept and marked as complete instead, as its work is now tracked by the new items.
+func (th *TodoHandler) SplitItem(c *gin.Context) {
+	id, err := th.parseID(c.Param("id"))
+	if err != nil {
+		c.String(http.StatusBadRequest, "Bad request: Id in url is not a valid id")
+		return
+	}
+	keepSource, err := strconv.ParseBool(c.DefaultQuery("keepSource", "false"))
+	if err != nil {
+		c.String(http.StatusBadRequest, "Bad request: keepSource must be true or false")
+		return
+	}
+	split := SplitTodoItem{}
+	if err := th.bindJSON(c, &split); err != nil || len(split.Names) == 0 {
+		c.String(http.StatusBadRequest, "Bad request: Names must contain at least one name")
+		return
+	}
+	for i := range split.Names {
+		if split.Names[i], err = validateName(split.Names[i]); err != nil {
+			c.String(http.StatusBadRequest, "Bad request: %v", err)
+			return
+		}
+	}
+
+	th.Lock()
+	defer th.Unlock()
+	source, ok := th.lookup(c, id)
+	if !ok {
+		c.String(http.StatusNotFound, `Not found: Item with id "%v"`, id)
+		return
+	}
+	if !checkIfMatch(c, source) {
+		return
+	}
+	if keepSource && th.blockOnIncompleteDependencies && !source.IsComplete {
+		if blocking := th.blockingDependencies(source.DependsOn); len(blocking) > 0 {
+			c.String(http.StatusConflict, `Conflict: Item "%v" is blocked by the incomplete items %v`, id, blocking)
+			return
+		}
+	}
+	// The source item stops counting as open either way, so it frees one slot of the open items limit.
+	open := th.openItems(ownerOf(c)) + len(split.Names)
+	if !source.IsComplete {
+		open--
+	}
+	if th.maxOpenItems > 0 && open > th.maxOpenItems {
+		c.String(http.StatusConflict, "Conflict: The limit of %v open items is reached, complete an item first", th.maxOpenItems)
+		return
+	}
+
+	created := make(TodoItemCollection, len(split.Names))
+	for i, name := range split.Names {
+		// The new items are parts of the source, so they share its due date, priority and tags
+		putItem := putFromItem(source)
+		putItem.Name, putItem.IsComplete = name, false
+		putItem.DependsOn = append([]int(nil), source.DependsOn...)
+		putItem.Tags = append([]string(nil), source.Tags...)
+		created[i] = th.create(source.Owner, putItem)
+	}
+	if keepSource {
+		source.IsComplete = true
+		th.items[id] = th.touch(source)
+	} else {
+		delete(th.items, id)
+		th.removeDependency(id)
+	}
+	th.ensureUniquePositions()
+	if !th.saveOrFail(c) {
+		return
+	}
+	// Rebalancing may have moved the new items, so read them again
+	for i := range created {
+		created[i] = th.items[created[i].Id]
+	}
+	th.warnOpenItemsLimit(c, open)
+	c.JSON(http.StatusCreated, created)
 }
 
 func (th *TodoHandler) DeleteItem(c *gin.Context) {
-	id, err := strconv.Atoi(c.Param("id"))
+	id, err := th.parseID(c.Param("id"))
 	if err != nil {
 		c.String(http.StatusBadRequest, "Bad request: Id in url is not a valid id")
 		return
 	}
 
 	th.Lock()
-	// Just check if the item exist in the map. The underscore is used to ignore the returned item, to safe memory.
-	_, ok := th.items[id]
+	defer th.Unlock()
+	// Check if the item exists and is still the version the client has seen
+	item, ok := th.lookup(c, id)
 	if !ok {
 		c.String(http.StatusNotFound, `Not found: Item with id "%v"`, id)
 		return
 	}
-	// Delete the item from the map
+	if !checkIfMatch(c, item) {
+		return
+	}
+	// Delete the item from the map and from the dependencies of the remaining items
 	delete(th.items, id)
-	th.Unlock()
+	th.removeDependency(id)
+	th.saveOrFail(c)
+}
+
+// The result of the GetETA function.
+type ETA struct {
+	// Sum of the estimates of all incomplete items.
+	EstimatedMinutes int
+	// Number of incomplete items with an estimate.
+	EstimatedItems int
+	// Number of incomplete items without an estimate. They are not part of the sum.
+	UnestimatedItems int
+	// When the estimated work is done if we start now and work productiveMinutesPerDay each day.
+	ProjectedCompletion time.Time
+}
+
+func (th *TodoHandler) GetETA(c *gin.Context) {
+	eta := ETA{}
+	th.RLock()
+	for _, item := range th.visibleItems(c) {
+		if item.IsComplete {
+			continue
+		}
+		if item.EstimateMinutes == nil {
+			eta.UnestimatedItems++
+			continue
+		}
+		eta.EstimatedItems++
+		eta.EstimatedMinutes += *item.EstimateMinutes
+	}
+	th.RUnlock()
+
+	// Every productive day takes a full calendar day, so we scale the work minutes up to real minutes.
+	calendarMinutes := eta.EstimatedMinutes * 24 * 60 / th.productiveMinutesPerDay
+	eta.ProjectedCompletion = th.clock.Now().Add(time.Duration(calendarMinutes) * time.Minute)
+	c.JSON(http.StatusOK, eta)
 }
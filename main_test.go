@@ -0,0 +1,1638 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The tests send requests to the real router with a memory store, so they cover the routes and middlewares as well.
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// Returns a handler with an empty memory store and its router. The configuration starts with the defaults of LoadConfig and can
+// be changed by configure before it's applied.
+func newTestServer(t *testing.T, configure func(cfg *Config)) (*TodoHandler, http.Handler) {
+	t.Helper()
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("loading the config failed: %v", err)
+	}
+	if configure != nil {
+		configure(&cfg)
+	}
+	store := NewMemoryStore()
+	th, err := NewTodoHandler(0, store)
+	if err != nil {
+		t.Fatalf("creating the handler failed: %v", err)
+	}
+	if err := cfg.Apply(&th); err != nil {
+		t.Fatalf("applying the config failed: %v", err)
+	}
+	r, err := NewRouter(cfg, &th, store, nil)
+	if err != nil {
+		t.Fatalf("creating the router failed: %v", err)
+	}
+	return &th, r
+}
+
+// Sends a request and returns the recorded response. headers are pairs of names and values.
+func request(r http.Handler, method, path, body string, headers ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// Fails the test unless the response has the given status.
+func expectStatus(t *testing.T, w *httptest.ResponseRecorder, status int) {
+	t.Helper()
+	if w.Code != status {
+		t.Fatalf("expected status %v, got %v: %v", status, w.Code, w.Body.String())
+	}
+}
+
+// Decodes the JSON body of the response into v.
+func decode(t *testing.T, w *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("decoding %q failed: %v", w.Body.String(), err)
+	}
+}
+
+// Creates an item from the JSON body and returns it.
+func createItem(t *testing.T, r http.Handler, body string) TodoItem {
+	t.Helper()
+	w := request(r, http.MethodPost, "/api/TodoItems", body)
+	expectStatus(t, w, http.StatusCreated)
+	item := TodoItem{}
+	decode(t, w, &item)
+	return item
+}
+
+// Sets an environment variable for the duration of the test.
+func setenv(t *testing.T, name, value string) {
+	old, ok := os.LookupEnv(name)
+	os.Setenv(name, value)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(name, old)
+		} else {
+			os.Unsetenv(name)
+		}
+	})
+}
+
+func TestAdminConfigShowsOverridesAndRedactsKey(t *testing.T) {
+	setenv(t, "TODO_ADMIN_API_KEY", "s3cret-key")
+	setenv(t, "TODO_MAX_OPEN_ITEMS", "7")
+	setenv(t, "TODO_ID_FORMAT", "hex")
+	_, r := newTestServer(t, nil)
+
+	expectStatus(t, request(r, http.MethodGet, "/api/admin/config", ""), http.StatusUnauthorized)
+	expectStatus(t, request(r, http.MethodGet, "/api/admin/config", "", "X-API-Key", "wrong"), http.StatusUnauthorized)
+
+	w := request(r, http.MethodGet, "/api/admin/config", "", "X-API-Key", "s3cret-key")
+	expectStatus(t, w, http.StatusOK)
+	if strings.Contains(w.Body.String(), "s3cret-key") {
+		t.Fatalf("the config shows the api key: %v", w.Body.String())
+	}
+	cfg := Config{}
+	decode(t, w, &cfg)
+	if cfg.MaxOpenItems != 7 || cfg.IDFormat != "hex" {
+		t.Errorf("expected the overrides MaxOpenItems 7 and IDFormat hex, got %v and %q", cfg.MaxOpenItems, cfg.IDFormat)
+	}
+	if cfg.AdminAPIKey != "[redacted]" {
+		t.Errorf("expected the key to be redacted, got %q", cfg.AdminAPIKey)
+	}
+}
+
+func TestAdminRoutesAreOffWithoutKey(t *testing.T) {
+	_, r := newTestServer(t, func(cfg *Config) { cfg.AdminAPIKey = "" })
+	expectStatus(t, request(r, http.MethodGet, "/api/admin/config", ""), http.StatusForbidden)
+	expectStatus(t, request(r, http.MethodPost, "/api/admin/normalize-positions", ""), http.StatusForbidden)
+}
+
+// A clock which always tells the same time until the test moves it.
+type fakeClock struct {
+	now time.Time
+}
+
+func (f *fakeClock) Now() time.Time { return f.now }
+
+func TestToggleSetsAndClearsCompletedAt(t *testing.T) {
+	th, r := newTestServer(t, nil)
+	clock := &fakeClock{now: time.Date(2021, 3, 1, 9, 0, 0, 0, time.UTC)}
+	th.clock = clock
+	item := createItem(t, r, `{"Name":"Water the plants"}`)
+	if item.CompletedAt != nil {
+		t.Fatalf("expected a new item to have no CompletedAt, got %v", item.CompletedAt)
+	}
+
+	clock.now = clock.now.Add(time.Hour)
+	w := request(r, http.MethodPost, "/api/TodoItems/1/toggle", "")
+	expectStatus(t, w, http.StatusOK)
+	decode(t, w, &item)
+	if !item.IsComplete || item.CompletedAt == nil || !item.CompletedAt.Equal(clock.now) {
+		t.Fatalf("expected the item to be completed at %v, got %v %v", clock.now, item.IsComplete, item.CompletedAt)
+	}
+
+	clock.now = clock.now.Add(time.Hour)
+	w = request(r, http.MethodPost, "/api/TodoItems/1/toggle", "")
+	expectStatus(t, w, http.StatusOK)
+	item = TodoItem{}
+	decode(t, w, &item)
+	if item.IsComplete || item.CompletedAt != nil {
+		t.Fatalf("expected the reopened item to have no CompletedAt, got %v %v", item.IsComplete, item.CompletedAt)
+	}
+}
+
+func TestGraphShowsDependencies(t *testing.T) {
+	_, r := newTestServer(t, nil)
+	createItem(t, r, `{"Name":"Buy paint"}`)
+	createItem(t, r, `{"Name":"Buy brushes"}`)
+	createItem(t, r, `{"Name":"Paint the fence","DependsOn":[1,2]}`)
+
+	w := request(r, http.MethodGet, "/api/TodoItems/graph", "")
+	expectStatus(t, w, http.StatusOK)
+	graph := Graph{}
+	decode(t, w, &graph)
+	if len(graph.Nodes) != 3 {
+		t.Errorf("expected 3 nodes, got %v", graph.Nodes)
+	}
+	expected := []GraphEdge{{From: 3, To: 1}, {From: 3, To: 2}}
+	if !reflect.DeepEqual(graph.Edges, expected) {
+		t.Errorf("expected the edges %v, got %v", expected, graph.Edges)
+	}
+	if len(graph.Cycles) != 0 {
+		t.Errorf("expected no cycles, got %v", graph.Cycles)
+	}
+}
+
+func TestCyclicDependencyIsRejected(t *testing.T) {
+	_, r := newTestServer(t, nil)
+	createItem(t, r, `{"Name":"Buy paint"}`)
+	createItem(t, r, `{"Name":"Paint the fence","DependsOn":[1]}`)
+
+	w := request(r, http.MethodPut, "/api/TodoItems/1", `{"Name":"Buy paint","DependsOn":[2]}`)
+	expectStatus(t, w, http.StatusConflict)
+	w = request(r, http.MethodGet, "/api/TodoItems/1", "")
+	item := TodoItem{}
+	decode(t, w, &item)
+	if len(item.DependsOn) != 0 {
+		t.Errorf("expected the rejected dependency not to be stored, got %v", item.DependsOn)
+	}
+}
+
+func TestDeletedDependenciesAreRemoved(t *testing.T) {
+	_, r := newTestServer(t, nil)
+	createItem(t, r, `{"Name":"Buy paint"}`)
+	createItem(t, r, `{"Name":"Buy brushes"}`)
+	item := createItem(t, r, `{"Name":"Paint the fence","DependsOn":[1,1,2,1]}`)
+	if !reflect.DeepEqual(item.DependsOn, []int{1, 2}) {
+		t.Fatalf("expected the duplicate dependencies to be dropped, got %v", item.DependsOn)
+	}
+	w := request(r, http.MethodPatch, "/api/TodoItems/3", `{"DependsOn":[2,2]}`)
+	expectStatus(t, w, http.StatusOK)
+	decode(t, w, &item)
+	if !reflect.DeepEqual(item.DependsOn, []int{2}) {
+		t.Fatalf("expected the duplicate dependencies of the PATCH to be dropped, got %v", item.DependsOn)
+	}
+
+	expectStatus(t, request(r, http.MethodDelete, "/api/TodoItems/2", ""), http.StatusOK)
+	w = request(r, http.MethodGet, "/api/TodoItems/3", "")
+	expectStatus(t, w, http.StatusOK)
+	item = TodoItem{}
+	decode(t, w, &item)
+	if len(item.DependsOn) != 0 {
+		t.Errorf("expected the deleted item to be removed from DependsOn, got %v", item.DependsOn)
+	}
+}
+
+func TestCompletingWithIncompleteDependencies(t *testing.T) {
+	_, r := newTestServer(t, func(cfg *Config) { cfg.BlockIncompleteDependencies = true })
+	createItem(t, r, `{"Name":"Buy paint"}`)
+	createItem(t, r, `{"Name":"Buy brushes"}`)
+	createItem(t, r, `{"Name":"Paint the fence","DependsOn":[1,2]}`)
+
+	// Item 1 has no dependencies, so it can always be completed
+	expectStatus(t, request(r, http.MethodPost, "/api/TodoItems/1/toggle", ""), http.StatusOK)
+
+	w := request(r, http.MethodPut, "/api/TodoItems/3", `{"Name":"Paint the fence","IsComplete":true,"DependsOn":[1,2]}`)
+	expectStatus(t, w, http.StatusConflict)
+	if !strings.Contains(w.Body.String(), "[2]") {
+		t.Errorf("expected the message to list the blocking item 2, got %q", w.Body.String())
+	}
+
+	expectStatus(t, request(r, http.MethodPost, "/api/TodoItems/2/toggle", ""), http.StatusOK)
+	expectStatus(t, request(r, http.MethodPost, "/api/TodoItems/3/toggle", ""), http.StatusOK)
+}
+
+// Returns the ids of the list in position order.
+func idsByPosition(t *testing.T, th *TodoHandler) []int {
+	t.Helper()
+	th.RLock()
+	defer th.RUnlock()
+	ids := []int{}
+	for _, item := range th.itemsByPosition() {
+		ids = append(ids, item.Id)
+	}
+	return ids
+}
+
+func TestMoveUsesMidpoints(t *testing.T) {
+	th, r := newTestServer(t, nil)
+	for _, name := range []string{"One", "Two", "Three", "Four"} {
+		createItem(t, r, `{"Name":"`+name+`"}`)
+	}
+
+	expectStatus(t, request(r, http.MethodPost, "/api/TodoItems/3/move", `{"After":1,"Before":2}`), http.StatusOK)
+	w := request(r, http.MethodPost, "/api/TodoItems/4/move", `{"After":1}`)
+	expectStatus(t, w, http.StatusOK)
+	moved := TodoItem{}
+	decode(t, w, &moved)
+
+	if ids := idsByPosition(t, th); !reflect.DeepEqual(ids, []int{1, 4, 3, 2}) {
+		t.Fatalf("expected the order [1 4 3 2], got %v", ids)
+	}
+	// Only the moved items got a new position, the others kept theirs
+	if th.items[3].Position != 1.5*positionGap || moved.Position != 1.25*positionGap {
+		t.Errorf("expected the midpoints %v and %v, got %v and %v", 1.5*positionGap, 1.25*positionGap, th.items[3].Position, moved.Position)
+	}
+	if th.items[1].Position != positionGap || th.items[2].Position != 2*positionGap {
+		t.Errorf("expected the neighbours to keep their positions, got %v and %v", th.items[1].Position, th.items[2].Position)
+	}
+}
+
+func TestMoveRebalancesWhenPrecisionRunsOut(t *testing.T) {
+	th, r := newTestServer(t, nil)
+	for _, name := range []string{"One", "Two", "Three", "Four", "Five"} {
+		createItem(t, r, `{"Name":"`+name+`"}`)
+	}
+	// Leave a hole, so we can tell when the positions were spread out again
+	expectStatus(t, request(r, http.MethodDelete, "/api/TodoItems/4", ""), http.StatusOK)
+
+	// Every move halves the gap between item 1 and the item after it, which a float64 can only do about 50 times
+	for i := 0; i < 100; i++ {
+		id := 2 + i%2
+		w := request(r, http.MethodPost, "/api/TodoItems/"+strconv.Itoa(id)+"/move", `{"After":1}`)
+		expectStatus(t, w, http.StatusOK)
+		if ids := idsByPosition(t, th); ids[1] != id {
+			t.Fatalf("move %v: expected item %v right after item 1, got %v", i, id, ids)
+		}
+	}
+	if th.items[5].Position != 4*positionGap {
+		t.Errorf("expected a rebalance to move item 5 to %v, got %v", 4*positionGap, th.items[5].Position)
+	}
+	// A rebalance isn't a change of the client, so the other items keep their version
+	if th.items[5].Version != 1 {
+		t.Errorf("expected item 5 to keep version 1, got %v", th.items[5].Version)
+	}
+}
+
+// Returns the names of the items in the response, which has to be a JSON array of items.
+func names(t *testing.T, w *httptest.ResponseRecorder) []string {
+	t.Helper()
+	items := TodoItemCollection{}
+	decode(t, w, &items)
+	result := []string{}
+	for _, item := range items {
+		result = append(result, item.Name)
+	}
+	return result
+}
+
+func TestSyncAddsAndUpdates(t *testing.T) {
+	_, r := newTestServer(t, nil)
+	createItem(t, r, `{"Name":"Buy milk"}`)
+	createItem(t, r, `{"Name":"Call mom"}`)
+
+	w := request(r, http.MethodPost, "/api/TodoItems/sync", `[{"Id":1,"Name":"Buy oat milk"},{"Name":"Book flights"}]`)
+	expectStatus(t, w, http.StatusOK)
+	// Item 2 is missing in the body, but without deleteMissing it stays
+	if got := names(t, w); !reflect.DeepEqual(got, []string{"Buy oat milk", "Call mom", "Book flights"}) {
+		t.Errorf("unexpected items after the sync: %v", got)
+	}
+}
+
+func TestSyncDeletesMissing(t *testing.T) {
+	_, r := newTestServer(t, nil)
+	createItem(t, r, `{"Name":"Buy milk"}`)
+	createItem(t, r, `{"Name":"Call mom"}`)
+
+	w := request(r, http.MethodPost, "/api/TodoItems/sync?deleteMissing=true", `[{"Id":1,"Name":"Buy oat milk"},{"Name":"Book flights"}]`)
+	expectStatus(t, w, http.StatusOK)
+	if got := names(t, w); !reflect.DeepEqual(got, []string{"Buy oat milk", "Book flights"}) {
+		t.Errorf("unexpected items after the sync: %v", got)
+	}
+	expectStatus(t, request(r, http.MethodGet, "/api/TodoItems/2", ""), http.StatusNotFound)
+}
+
+func TestSyncRollsBackOnInvalidItem(t *testing.T) {
+	// In every body the update of item 1 and the delete of item 2 are fine, but the new item is invalid
+	bodies := map[string]string{
+		"unknown dependency": `[{"Id":1,"Name":"Buy oat milk"},{"Name":"Book flights","DependsOn":[42]}]`,
+		"negative estimate":  `[{"Id":1,"Name":"Buy oat milk"},{"Name":"Book flights","EstimateMinutes":-5}]`,
+	}
+	for name, body := range bodies {
+		t.Run(name, func(t *testing.T) {
+			_, r := newTestServer(t, nil)
+			createItem(t, r, `{"Name":"Buy milk"}`)
+			createItem(t, r, `{"Name":"Call mom"}`)
+
+			w := request(r, http.MethodPost, "/api/TodoItems/sync?deleteMissing=true", body)
+			expectStatus(t, w, http.StatusBadRequest)
+
+			w = request(r, http.MethodGet, "/api/TodoItems", "")
+			expectStatus(t, w, http.StatusOK)
+			if got := names(t, w); !reflect.DeepEqual(got, []string{"Buy milk", "Call mom"}) {
+				t.Errorf("expected the sync to be rolled back, got %v", got)
+			}
+		})
+	}
+}
+
+func TestPlanClassifiesChanges(t *testing.T) {
+	_, r := newTestServer(t, nil)
+	createItem(t, r, `{"Name":"Buy milk"}`)
+	createItem(t, r, `{"Name":"Call mom"}`)
+	createItem(t, r, `{"Name":"Pay rent"}`)
+
+	// Item 1 is unchanged, item 2 is renamed, item 3 is missing and an item without id is new
+	w := request(r, http.MethodPost, "/api/TodoItems/plan", `[{"Id":1,"Name":"Buy milk"},{"Id":2,"Name":"Call dad"},{"Name":"Book flights"}]`)
+	expectStatus(t, w, http.StatusOK)
+	plan := SyncPlan{}
+	decode(t, w, &plan)
+	if len(plan.Creates) != 1 || plan.Creates[0].Name != "Book flights" {
+		t.Errorf("expected one create of Book flights, got %v", plan.Creates)
+	}
+	if len(plan.Updates) != 1 || plan.Updates[0].Id != 2 {
+		t.Fatalf("expected one update of item 2, got %v", plan.Updates)
+	}
+	if change, ok := plan.Updates[0].Changes["Name"]; !ok || change.Old != "Call mom" || change.New != "Call dad" || len(plan.Updates[0].Changes) != 1 {
+		t.Errorf("expected only the name of item 2 to change, got %v", plan.Updates[0].Changes)
+	}
+	if !reflect.DeepEqual(plan.Deletes, []int{3}) {
+		t.Errorf("expected item 3 to be deleted, got %v", plan.Deletes)
+	}
+
+	// A plan doesn't change anything
+	w = request(r, http.MethodGet, "/api/TodoItems", "")
+	if got := names(t, w); !reflect.DeepEqual(got, []string{"Buy milk", "Call mom", "Pay rent"}) {
+		t.Errorf("expected the items to stay unchanged, got %v", got)
+	}
+}
+
+func TestPlanRejectsInvalidItems(t *testing.T) {
+	_, r := newTestServer(t, nil)
+	createItem(t, r, `{"Name":"Buy milk"}`)
+
+	w := request(r, http.MethodPost, "/api/TodoItems/plan", `[{"Id":1,"Name":"Buy milk"},{"Name":"Book flights","EstimateMinutes":-5}]`)
+	expectStatus(t, w, http.StatusBadRequest)
+	if !strings.Contains(w.Body.String(), "Item 1") {
+		t.Errorf("expected the message to name item 1, got %q", w.Body.String())
+	}
+}
+
+// Creates the items of the find and replace tests.
+func createQuarterItems(t *testing.T, r http.Handler) {
+	t.Helper()
+	createItem(t, r, `{"Name":"Q1 report"}`)
+	createItem(t, r, `{"Name":"Plan Q1 budget"}`)
+	createItem(t, r, `{"Name":"Team lunch"}`)
+}
+
+func TestFindReplaceLiteral(t *testing.T) {
+	_, r := newTestServer(t, nil)
+	createQuarterItems(t, r)
+
+	w := request(r, http.MethodPost, "/api/TodoItems/find-replace", `{"Find":"Q1","Replace":"Q2"}`)
+	expectStatus(t, w, http.StatusOK)
+	result := FindReplaceResult{}
+	decode(t, w, &result)
+	if len(result.Items) != 2 || result.DryRun {
+		t.Fatalf("expected 2 renamed items, got %v", result)
+	}
+	w = request(r, http.MethodGet, "/api/TodoItems", "")
+	if got := names(t, w); !reflect.DeepEqual(got, []string{"Q2 report", "Plan Q2 budget", "Team lunch"}) {
+		t.Errorf("unexpected names after the replace: %v", got)
+	}
+}
+
+func TestFindReplaceRegex(t *testing.T) {
+	_, r := newTestServer(t, nil)
+	createQuarterItems(t, r)
+
+	w := request(r, http.MethodPost, "/api/TodoItems/find-replace", `{"Find":"Q(\\d)","Replace":"Quarter $1","Regex":true}`)
+	expectStatus(t, w, http.StatusOK)
+	w = request(r, http.MethodGet, "/api/TodoItems", "")
+	if got := names(t, w); !reflect.DeepEqual(got, []string{"Quarter 1 report", "Plan Quarter 1 budget", "Team lunch"}) {
+		t.Errorf("unexpected names after the replace: %v", got)
+	}
+}
+
+func TestFindReplaceDryRun(t *testing.T) {
+	_, r := newTestServer(t, nil)
+	createQuarterItems(t, r)
+
+	w := request(r, http.MethodPost, "/api/TodoItems/find-replace?dryRun=true", `{"Find":"Q1","Replace":"Q2"}`)
+	expectStatus(t, w, http.StatusOK)
+	result := FindReplaceResult{}
+	decode(t, w, &result)
+	if !result.DryRun || len(result.Items) != 2 || result.Items[0].Name != "Q2 report" {
+		t.Errorf("expected a dry run showing the 2 new names, got %v", result)
+	}
+	w = request(r, http.MethodGet, "/api/TodoItems", "")
+	if got := names(t, w); !reflect.DeepEqual(got, []string{"Q1 report", "Plan Q1 budget", "Team lunch"}) {
+		t.Errorf("expected a dry run to change nothing, got %v", got)
+	}
+}
+
+func TestFindReplaceByTag(t *testing.T) {
+	_, r := newTestServer(t, nil)
+	createItem(t, r, `{"Name":"Q1 report","Tags":["finance"]}`)
+	createItem(t, r, `{"Name":"Plan Q1 budget"}`)
+	createItem(t, r, `{"Name":"Q1 review","Tags":["Finance","team"]}`)
+
+	w := request(r, http.MethodPost, "/api/TodoItems/find-replace?tag=finance", `{"Find":"Q1","Replace":"Q2"}`)
+	expectStatus(t, w, http.StatusOK)
+	w = request(r, http.MethodGet, "/api/TodoItems", "")
+	if got := names(t, w); !reflect.DeepEqual(got, []string{"Q2 report", "Plan Q1 budget", "Q2 review"}) {
+		t.Errorf("expected only the items tagged finance to be renamed, got %v", got)
+	}
+
+	// Together with Ids only the listed items which carry the tag are renamed
+	w = request(r, http.MethodPost, "/api/TodoItems/find-replace?tag=team", `{"Find":"Q","Replace":"Quarter ","Ids":[1,2,3]}`)
+	expectStatus(t, w, http.StatusOK)
+	result := FindReplaceResult{}
+	decode(t, w, &result)
+	if len(result.Items) != 1 || result.Items[0].Name != "Quarter 2 review" || len(result.Missing) != 0 {
+		t.Errorf("expected only item 3 to be renamed, got %v", result)
+	}
+}
+
+func TestFindReplaceRejectsBadPattern(t *testing.T) {
+	_, r := newTestServer(t, nil)
+	createQuarterItems(t, r)
+	expectStatus(t, request(r, http.MethodPost, "/api/TodoItems/find-replace", `{"Find":"Q(1","Replace":"Q2","Regex":true}`), http.StatusBadRequest)
+}
+
+func TestTrailingCommaNeedsLenientJSON(t *testing.T) {
+	body := `{"Name":"Buy milk", "Tags":["shopping",],}`
+	_, strict := newTestServer(t, nil)
+	expectStatus(t, request(strict, http.MethodPost, "/api/TodoItems", body), http.StatusBadRequest)
+
+	_, lenient := newTestServer(t, func(cfg *Config) { cfg.LenientJSON = true })
+	item := createItem(t, lenient, body)
+	if item.Name != "Buy milk" || !reflect.DeepEqual(item.Tags, []string{"shopping"}) {
+		t.Errorf("expected the salvaged body to be stored, got %v %v", item.Name, item.Tags)
+	}
+}
+
+func TestCompletedItemsAreLocked(t *testing.T) {
+	_, r := newTestServer(t, func(cfg *Config) { cfg.LockCompletedItems = true })
+	createItem(t, r, `{"Name":"Buy milk"}`)
+	expectStatus(t, request(r, http.MethodPost, "/api/TodoItems/1/toggle", ""), http.StatusOK)
+
+	expectStatus(t, request(r, http.MethodPut, "/api/TodoItems/1", `{"Name":"Buy oat milk","IsComplete":true}`), http.StatusLocked)
+	expectStatus(t, request(r, http.MethodPatch, "/api/TodoItems/1", `{"Name":"Buy oat milk"}`), http.StatusLocked)
+	// Reopening and renaming at the same time is still an edit of the completed item
+	expectStatus(t, request(r, http.MethodPut, "/api/TodoItems/1", `{"Name":"Buy oat milk","IsComplete":false}`), http.StatusLocked)
+}
+
+func TestLockedItemsCanBeReopened(t *testing.T) {
+	_, r := newTestServer(t, func(cfg *Config) { cfg.LockCompletedItems = true })
+	createItem(t, r, `{"Name":"Buy milk"}`)
+	expectStatus(t, request(r, http.MethodPost, "/api/TodoItems/1/toggle", ""), http.StatusOK)
+
+	w := request(r, http.MethodPatch, "/api/TodoItems/1", `{"IsComplete":false}`)
+	expectStatus(t, w, http.StatusOK)
+	item := TodoItem{}
+	decode(t, w, &item)
+	if item.IsComplete {
+		t.Fatalf("expected the item to be reopened")
+	}
+	// Once it's open again it can be edited
+	expectStatus(t, request(r, http.MethodPatch, "/api/TodoItems/1", `{"Name":"Buy oat milk"}`), http.StatusOK)
+}
+
+func TestReopeningCanBeForbidden(t *testing.T) {
+	_, r := newTestServer(t, func(cfg *Config) { cfg.LockCompletedItems, cfg.ForbidReopening = true, true })
+	createItem(t, r, `{"Name":"Buy milk"}`)
+	expectStatus(t, request(r, http.MethodPost, "/api/TodoItems/1/toggle", ""), http.StatusOK)
+	expectStatus(t, request(r, http.MethodPost, "/api/TodoItems/1/toggle", ""), http.StatusLocked)
+}
+
+func TestNoopPutIsSkipped(t *testing.T) {
+	th, r := newTestServer(t, func(cfg *Config) { cfg.SkipNoopUpdates = true })
+	clock := &fakeClock{now: time.Date(2021, 3, 1, 9, 0, 0, 0, time.UTC)}
+	th.clock = clock
+	created := createItem(t, r, `{"Name":"Buy milk","Tags":["shopping"]}`)
+
+	clock.now = clock.now.Add(time.Hour)
+	w := request(r, http.MethodPut, "/api/TodoItems/1", `{"Name":"Buy milk","Tags":["shopping"]}`)
+	expectStatus(t, w, http.StatusOK)
+	if w.Header().Get("X-No-Change") != "true" {
+		t.Errorf("expected the X-No-Change header")
+	}
+	item := TodoItem{}
+	decode(t, w, &item)
+	if !item.UpdatedAt.Equal(created.UpdatedAt) || item.Version != created.Version {
+		t.Errorf("expected the stored item to stay untouched, got %v and version %v", item.UpdatedAt, item.Version)
+	}
+}
+
+func TestRealPutIsApplied(t *testing.T) {
+	th, r := newTestServer(t, func(cfg *Config) { cfg.SkipNoopUpdates = true })
+	clock := &fakeClock{now: time.Date(2021, 3, 1, 9, 0, 0, 0, time.UTC)}
+	th.clock = clock
+	created := createItem(t, r, `{"Name":"Buy milk"}`)
+
+	clock.now = clock.now.Add(time.Hour)
+	w := request(r, http.MethodPut, "/api/TodoItems/1", `{"Name":"Buy oat milk"}`)
+	expectStatus(t, w, http.StatusOK)
+	if w.Header().Get("X-No-Change") != "" {
+		t.Errorf("expected no X-No-Change header for a real change")
+	}
+	item := TodoItem{}
+	decode(t, w, &item)
+	if item.Name != "Buy oat milk" || !item.UpdatedAt.Equal(clock.now) || item.Version != created.Version+1 {
+		t.Errorf("expected the change to be stored, got %q, %v and version %v", item.Name, item.UpdatedAt, item.Version)
+	}
+}
+
+func TestOpenItemsLimit(t *testing.T) {
+	_, r := newTestServer(t, func(cfg *Config) { cfg.MaxOpenItems = 2 })
+	createItem(t, r, `{"Name":"Buy milk"}`)
+	createItem(t, r, `{"Name":"Call mom"}`)
+
+	w := request(r, http.MethodPost, "/api/TodoItems", `{"Name":"Pay rent"}`)
+	expectStatus(t, w, http.StatusConflict)
+	if !strings.Contains(w.Body.String(), "limit of 2") {
+		t.Errorf("expected the message to state the limit, got %q", w.Body.String())
+	}
+
+	// Completing an item frees its slot
+	expectStatus(t, request(r, http.MethodPost, "/api/TodoItems/1/toggle", ""), http.StatusOK)
+	createItem(t, r, `{"Name":"Pay rent"}`)
+}
+
+// Registers a user and returns a token of it.
+func login(t *testing.T, r http.Handler, username string) string {
+	t.Helper()
+	credentials := `{"Username":"` + username + `","Password":"correct horse"}`
+	expectStatus(t, request(r, http.MethodPost, "/api/users/register", credentials), http.StatusCreated)
+	w := request(r, http.MethodPost, "/api/users/login", credentials)
+	expectStatus(t, w, http.StatusOK)
+	result := LoginResult{}
+	decode(t, w, &result)
+	return result.Token
+}
+
+func TestReopeningRespectsOpenItemsLimit(t *testing.T) {
+	_, r := newTestServer(t, func(cfg *Config) { cfg.MaxOpenItems = 1 })
+	createItem(t, r, `{"Name":"Buy milk"}`)
+	expectStatus(t, request(r, http.MethodPost, "/api/TodoItems/1/toggle", ""), http.StatusOK)
+	createItem(t, r, `{"Name":"Call mom"}`)
+
+	// Item 2 takes the only slot, so item 1 can't be reopened in any way
+	reopens := []struct{ method, path, body string }{
+		{http.MethodPost, "/api/TodoItems/1/toggle", ""},
+		{http.MethodPut, "/api/TodoItems/1", `{"Name":"Buy milk"}`},
+		{http.MethodPatch, "/api/TodoItems/1", `{"IsComplete":false}`},
+	}
+	for _, reopen := range reopens {
+		w := request(r, reopen.method, reopen.path, reopen.body)
+		expectStatus(t, w, http.StatusConflict)
+	}
+	// Other changes of the completed item are still fine
+	expectStatus(t, request(r, http.MethodPatch, "/api/TodoItems/1", `{"Name":"Buy oat milk"}`), http.StatusOK)
+
+	expectStatus(t, request(r, http.MethodPost, "/api/TodoItems/2/toggle", ""), http.StatusOK)
+	expectStatus(t, request(r, http.MethodPost, "/api/TodoItems/1/toggle", ""), http.StatusOK)
+}
+
+func TestOpenItemsLimitIsPerUser(t *testing.T) {
+	_, r := newTestServer(t, func(cfg *Config) {
+		cfg.MaxOpenItems = 1
+		cfg.Auth, cfg.JWTSecret = true, "test secret"
+	})
+	alice, bob := "Bearer "+login(t, r, "alice"), "Bearer "+login(t, r, "bob")
+
+	expectStatus(t, request(r, http.MethodPost, "/api/TodoItems", `{"Name":"Buy milk"}`, "Authorization", alice), http.StatusCreated)
+	expectStatus(t, request(r, http.MethodPost, "/api/TodoItems", `{"Name":"Call mom"}`, "Authorization", alice), http.StatusConflict)
+	// The items of alice don't count for bob
+	expectStatus(t, request(r, http.MethodPost, "/api/TodoItems", `{"Name":"Pay rent"}`, "Authorization", bob), http.StatusCreated)
+}
+
+func TestSoftLimitWarnsBeforeTheCap(t *testing.T) {
+	_, r := newTestServer(t, func(cfg *Config) { cfg.MaxOpenItems, cfg.SoftLimitPercent = 5, 80 })
+	for i := 1; i <= 5; i++ {
+		w := request(r, http.MethodPost, "/api/TodoItems", `{"Name":"Item `+strconv.Itoa(i)+`"}`)
+		expectStatus(t, w, http.StatusCreated)
+		warning := w.Header().Get("Warning")
+		// 80% of 5 are 4 items
+		if i < 4 && warning != "" {
+			t.Errorf("item %v: expected no warning below the soft limit, got %q", i, warning)
+		}
+		if i >= 4 && !strings.HasPrefix(warning, `199 - "`+strconv.Itoa(i)+" of 5 open items used") {
+			t.Errorf("item %v: expected a warning at the soft limit, got %q", i, warning)
+		}
+	}
+	w := request(r, http.MethodPost, "/api/TodoItems", `{"Name":"Item 6"}`)
+	expectStatus(t, w, http.StatusConflict)
+}
+
+func TestOverdueFollowsTheClock(t *testing.T) {
+	th, r := newTestServer(t, nil)
+	clock := &fakeClock{now: time.Date(2021, 3, 1, 9, 0, 0, 0, time.UTC)}
+	th.clock = clock
+	createItem(t, r, `{"Name":"Pay rent","DueDate":"2021-03-02T00:00:00Z"}`)
+	createItem(t, r, `{"Name":"Book flights","DueDate":"2021-03-05T00:00:00Z"}`)
+	createItem(t, r, `{"Name":"Someday"}`)
+	// New due dates must not be in the past of the clock
+	expectStatus(t, request(r, http.MethodPost, "/api/TodoItems", `{"Name":"Too late","DueDate":"2021-02-28T00:00:00Z"}`), http.StatusBadRequest)
+
+	w := request(r, http.MethodGet, "/api/TodoItems?overdue=true", "")
+	if got := names(t, w); len(got) != 0 {
+		t.Errorf("expected nothing to be overdue yet, got %v", got)
+	}
+
+	clock.now = time.Date(2021, 3, 3, 9, 0, 0, 0, time.UTC)
+	w = request(r, http.MethodGet, "/api/TodoItems?overdue=true", "")
+	if got := names(t, w); !reflect.DeepEqual(got, []string{"Pay rent"}) {
+		t.Errorf("expected Pay rent to be overdue, got %v", got)
+	}
+	w = request(r, http.MethodGet, "/api/TodoItems?overdue=false", "")
+	if got := names(t, w); !reflect.DeepEqual(got, []string{"Book flights", "Someday"}) {
+		t.Errorf("unexpected items which are not overdue: %v", got)
+	}
+}
+
+func TestClockOffsetShiftsOverdue(t *testing.T) {
+	th, r := newTestServer(t, nil)
+	clock := &fakeClock{now: time.Date(2021, 3, 1, 9, 0, 0, 0, time.UTC)}
+	th.clock = clock
+	createItem(t, r, `{"Name":"Pay rent","DueDate":"2021-03-01T10:00:00Z"}`)
+
+	// The server clock is an hour and a half behind, so the item is already overdue
+	th.clock = offsetClock{clock: clock, offset: 90 * time.Minute}
+	w := request(r, http.MethodGet, "/api/TodoItems?overdue=true", "")
+	if got := names(t, w); !reflect.DeepEqual(got, []string{"Pay rent"}) {
+		t.Errorf("expected Pay rent to be overdue with the offset, got %v", got)
+	}
+}
+
+func TestETAStartsAtTheClock(t *testing.T) {
+	th, r := newTestServer(t, nil)
+	clock := &fakeClock{now: time.Date(2021, 3, 1, 9, 0, 0, 0, time.UTC)}
+	th.clock = clock
+	createItem(t, r, `{"Name":"Write report","EstimateMinutes":480}`)
+
+	w := request(r, http.MethodGet, "/api/TodoItems/eta", "")
+	expectStatus(t, w, http.StatusOK)
+	eta := ETA{}
+	decode(t, w, &eta)
+	// 480 minutes are one productive day, which takes a full calendar day
+	if expected := clock.now.Add(24 * time.Hour); !eta.ProjectedCompletion.Equal(expected) {
+		t.Errorf("expected the projected completion %v, got %v", expected, eta.ProjectedCompletion)
+	}
+}
+
+func TestPreviewUpdateShowsChangedFields(t *testing.T) {
+	_, r := newTestServer(t, nil)
+	createItem(t, r, `{"Name":"Buy milk","Tags":["shopping"]}`)
+
+	w := request(r, http.MethodPost, "/api/TodoItems/1/preview-update", `{"Name":"Buy oat milk","Tags":["shopping"],"Priority":"high"}`)
+	expectStatus(t, w, http.StatusOK)
+	preview := UpdatePreview{}
+	decode(t, w, &preview)
+	if len(preview.Changes) != 2 {
+		t.Errorf("expected only Name and Priority to change, got %v", preview.Changes)
+	}
+	if change := preview.Changes["Name"]; change.Old != "Buy milk" || change.New != "Buy oat milk" {
+		t.Errorf("unexpected change of the name: %v", change)
+	}
+	if change := preview.Changes["Priority"]; change.Old != "normal" || change.New != "high" {
+		t.Errorf("unexpected change of the priority: %v", change)
+	}
+	for _, field := range []string{"Id", "Tags", "IsComplete"} {
+		if _, ok := preview.Changes[field]; ok {
+			t.Errorf("expected the unchanged field %v to be left out", field)
+		}
+	}
+
+	// Nothing is stored
+	w = request(r, http.MethodGet, "/api/TodoItems/1", "")
+	item := TodoItem{}
+	decode(t, w, &item)
+	if item.Name != "Buy milk" {
+		t.Errorf("expected the preview not to change the item, got %q", item.Name)
+	}
+	expectStatus(t, request(r, http.MethodPost, "/api/TodoItems/2/preview-update", `{"Name":"Anything"}`), http.StatusNotFound)
+}
+
+func TestSplitDeletesTheSource(t *testing.T) {
+	_, r := newTestServer(t, nil)
+	createItem(t, r, `{"Name":"Buy paint"}`)
+	createItem(t, r, `{"Name":"Renovate the kitchen","DependsOn":[1],"Tags":["home"]}`)
+
+	w := request(r, http.MethodPost, "/api/TodoItems/2/split", `{"Names":["Paint the walls","Tile the floor","Fix the sink"]}`)
+	expectStatus(t, w, http.StatusCreated)
+	created := TodoItemCollection{}
+	decode(t, w, &created)
+	if len(created) != 3 {
+		t.Fatalf("expected 3 new items, got %v", created)
+	}
+	for i, name := range []string{"Paint the walls", "Tile the floor", "Fix the sink"} {
+		item := created[i]
+		if item.Name != name || item.IsComplete || !reflect.DeepEqual(item.DependsOn, []int{1}) || !reflect.DeepEqual(item.Tags, []string{"home"}) {
+			t.Errorf("expected an open item %q inheriting the dependencies and tags, got %+v", name, item)
+		}
+	}
+	expectStatus(t, request(r, http.MethodGet, "/api/TodoItems/2", ""), http.StatusNotFound)
+}
+
+func TestSplitKeepsTheSource(t *testing.T) {
+	_, r := newTestServer(t, nil)
+	createItem(t, r, `{"Name":"Renovate the kitchen"}`)
+
+	w := request(r, http.MethodPost, "/api/TodoItems/1/split?keepSource=true", `{"Names":["Paint the walls","Tile the floor","Fix the sink"]}`)
+	expectStatus(t, w, http.StatusCreated)
+	created := TodoItemCollection{}
+	decode(t, w, &created)
+	if len(created) != 3 {
+		t.Fatalf("expected 3 new items, got %v", created)
+	}
+	w = request(r, http.MethodGet, "/api/TodoItems/1", "")
+	expectStatus(t, w, http.StatusOK)
+	source := TodoItem{}
+	decode(t, w, &source)
+	if !source.IsComplete {
+		t.Errorf("expected the kept source to be completed")
+	}
+	expectStatus(t, request(r, http.MethodPost, "/api/TodoItems/1/split", `{"Names":[]}`), http.StatusBadRequest)
+	expectStatus(t, request(r, http.MethodPost, "/api/TodoItems/9/split", `{"Names":["Anything"]}`), http.StatusNotFound)
+}
+
+func TestNormalizePositionsMakesThemUnique(t *testing.T) {
+	th, r := newTestServer(t, func(cfg *Config) { cfg.AdminAPIKey = "admin key" })
+	for _, name := range []string{"One", "Two", "Three", "Four"} {
+		createItem(t, r, `{"Name":"`+name+`"}`)
+	}
+	// There is no route which stores colliding positions, so we break them by hand like an old data file could
+	th.Lock()
+	for id, position := range map[int]float64{1: 5, 2: 5, 3: 1, 4: 5} {
+		item := th.items[id]
+		item.Position = position
+		th.items[id] = item
+	}
+	th.Unlock()
+
+	w := request(r, http.MethodPost, "/api/admin/normalize-positions", "", "X-API-Key", "admin key")
+	expectStatus(t, w, http.StatusOK)
+	items := TodoItemCollection{}
+	decode(t, w, &items)
+	// Items sharing a position stay ordered by id
+	for i, id := range []int{3, 1, 2, 4} {
+		if items[i].Id != id || items[i].Position != float64(i+1)*positionGap {
+			t.Errorf("expected item %v at position %v, got item %v at %v", id, float64(i+1)*positionGap, items[i].Id, items[i].Position)
+		}
+	}
+}
+
+func TestIDFormats(t *testing.T) {
+	tests := []struct {
+		format, prefix, valid, invalid string
+	}{
+		{format: "decimal", valid: "12", invalid: "0xc"},
+		{format: "hex", valid: "0xc", invalid: "0xzz"},
+		{format: "prefixed", prefix: "TODO-", valid: "TODO-12", invalid: "TASK-12"},
+	}
+	for _, test := range tests {
+		t.Run(test.format, func(t *testing.T) {
+			_, r := newTestServer(t, func(cfg *Config) { cfg.IDFormat, cfg.IDPrefix = test.format, test.prefix })
+			for i := 1; i <= 12; i++ {
+				createItem(t, r, `{"Name":"Item `+strconv.Itoa(i)+`"}`)
+			}
+
+			w := request(r, http.MethodGet, "/api/TodoItems/"+test.valid, "")
+			expectStatus(t, w, http.StatusOK)
+			item := TodoItem{}
+			decode(t, w, &item)
+			if item.Id != 12 {
+				t.Errorf("expected %q to be item 12, got %v", test.valid, item.Id)
+			}
+			expectStatus(t, request(r, http.MethodGet, "/api/TodoItems/"+test.invalid, ""), http.StatusBadRequest)
+		})
+	}
+}
+
+func TestETASumsEstimatedItems(t *testing.T) {
+	th, r := newTestServer(t, func(cfg *Config) { cfg.ProductiveMinutesPerDay = 360 })
+	clock := &fakeClock{now: time.Date(2021, 3, 1, 9, 0, 0, 0, time.UTC)}
+	th.clock = clock
+	createItem(t, r, `{"Name":"Write report","EstimateMinutes":120}`)
+	createItem(t, r, `{"Name":"Review report","EstimateMinutes":60}`)
+	createItem(t, r, `{"Name":"Think about it"}`)
+	createItem(t, r, `{"Name":"Old work","EstimateMinutes":500}`)
+	// Completed work doesn't count anymore
+	expectStatus(t, request(r, http.MethodPost, "/api/TodoItems/4/toggle", ""), http.StatusOK)
+
+	w := request(r, http.MethodGet, "/api/TodoItems/eta", "")
+	expectStatus(t, w, http.StatusOK)
+	eta := ETA{}
+	decode(t, w, &eta)
+	if eta.EstimatedMinutes != 180 || eta.EstimatedItems != 2 || eta.UnestimatedItems != 1 {
+		t.Errorf("expected 180 minutes of 2 estimated items and 1 unestimated item, got %+v", eta)
+	}
+	// 180 minutes are half of a productive day of 360 minutes, so half a calendar day
+	if expected := clock.now.Add(12 * time.Hour); !eta.ProjectedCompletion.Equal(expected) {
+		t.Errorf("expected the projected completion %v, got %v", expected, eta.ProjectedCompletion)
+	}
+}
+
+func TestHeadMatchesGet(t *testing.T) {
+	_, r := newTestServer(t, nil)
+	createItem(t, r, `{"Name":"Buy milk"}`)
+	createItem(t, r, `{"Name":"Call mom"}`)
+	// The recorder keeps the body of a HEAD request, only a real server drops it
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	for path, status := range map[string]int{"/api/TodoItems": 200, "/api/TodoItems/1": 200, "/api/TodoItems/9": 404} {
+		get, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		get.Body.Close()
+		head, err := http.Head(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(head.Body)
+		head.Body.Close()
+
+		if get.StatusCode != status || head.StatusCode != status {
+			t.Errorf("%v: expected the status %v for GET and HEAD, got %v and %v", path, status, get.StatusCode, head.StatusCode)
+		}
+		if len(body) != 0 {
+			t.Errorf("%v: expected no body, got %q", path, body)
+		}
+		for _, name := range []string{"Content-Type", "Content-Length", "ETag", "Last-Modified", "X-Total-Count", "X-API-Version"} {
+			if head.Header.Get(name) != get.Header.Get(name) {
+				t.Errorf("%v: expected the %v header %q of the GET, got %q", path, name, get.Header.Get(name), head.Header.Get(name))
+			}
+		}
+	}
+}
+
+func TestLastModifiedFollowsUpdatedAt(t *testing.T) {
+	th, r := newTestServer(t, nil)
+	clock := &fakeClock{now: time.Date(2021, 3, 1, 9, 0, 0, 500000000, time.UTC)}
+	th.clock = clock
+	createItem(t, r, `{"Name":"Buy milk"}`)
+
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		w := request(r, method, "/api/TodoItems/1", "")
+		expectStatus(t, w, http.StatusOK)
+		if got := w.Header().Get("Last-Modified"); got != "Mon, 01 Mar 2021 09:00:00 GMT" {
+			t.Errorf("%v: expected the Last-Modified of UpdatedAt, got %q", method, got)
+		}
+	}
+	w := request(r, http.MethodGet, "/api/TodoItems/1", "", "If-Modified-Since", "Mon, 01 Mar 2021 09:00:00 GMT")
+	expectStatus(t, w, http.StatusNotModified)
+	if w.Header().Get("ETag") != `"1"` {
+		t.Errorf("expected the 304 to carry the ETag, got %q", w.Header().Get("ETag"))
+	}
+	expectStatus(t, request(r, http.MethodGet, "/api/TodoItems/1", "", "If-Modified-Since", "Mon, 01 Mar 2021 08:59:59 GMT"), http.StatusOK)
+	// If-None-Match wins over If-Modified-Since
+	expectStatus(t, request(r, http.MethodGet, "/api/TodoItems/1", "", "If-Modified-Since", "Mon, 01 Mar 2021 09:00:00 GMT", "If-None-Match", `"0"`), http.StatusOK)
+
+	clock.now = clock.now.Add(time.Minute)
+	expectStatus(t, request(r, http.MethodPatch, "/api/TodoItems/1", `{"Name":"Buy oat milk"}`), http.StatusOK)
+	expectStatus(t, request(r, http.MethodGet, "/api/TodoItems/1", "", "If-Modified-Since", "Mon, 01 Mar 2021 09:00:00 GMT"), http.StatusOK)
+}
+
+func TestExcludeFields(t *testing.T) {
+	_, r := newTestServer(t, nil)
+	createItem(t, r, `{"Name":"Buy milk","Tags":["shopping"]}`)
+	check := func(item map[string]interface{}) {
+		t.Helper()
+		if _, ok := item["Tags"]; ok {
+			t.Errorf("expected Tags to be left out, got %v", item)
+		}
+		if _, ok := item["DependsOn"]; ok {
+			t.Errorf("expected DependsOn to be left out, got %v", item)
+		}
+		if item["Id"] != 1.0 || item["Name"] != "Buy milk" {
+			t.Errorf("expected the other fields to stay, got %v", item)
+		}
+	}
+
+	w := request(r, http.MethodGet, "/api/TodoItems/1?excludeFields=tags,DependsOn", "")
+	expectStatus(t, w, http.StatusOK)
+	item := map[string]interface{}{}
+	decode(t, w, &item)
+	check(item)
+
+	w = request(r, http.MethodGet, "/api/TodoItems?excludeFields=tags,DependsOn", "")
+	expectStatus(t, w, http.StatusOK)
+	list := []map[string]interface{}{}
+	decode(t, w, &list)
+	if len(list) != 1 {
+		t.Fatalf("expected one item, got %v", list)
+	}
+	check(list[0])
+}
+
+func TestIdCannotBeExcluded(t *testing.T) {
+	_, r := newTestServer(t, nil)
+	createItem(t, r, `{"Name":"Buy milk"}`)
+	expectStatus(t, request(r, http.MethodGet, "/api/TodoItems/1?excludeFields=Name,Id", ""), http.StatusBadRequest)
+	expectStatus(t, request(r, http.MethodGet, "/api/TodoItems?excludeFields=id", ""), http.StatusBadRequest)
+}
+
+func TestIncludeFields(t *testing.T) {
+	_, r := newTestServer(t, nil)
+	createItem(t, r, `{"Name":"Buy milk","Tags":["shopping"]}`)
+
+	for _, path := range []string{"/api/TodoItems/1?fields=name,Tags", "/api/TodoItems?fields=name,Tags"} {
+		w := request(r, http.MethodGet, path, "")
+		expectStatus(t, w, http.StatusOK)
+		item := map[string]interface{}{}
+		if strings.HasPrefix(w.Body.String(), "[") {
+			list := []map[string]interface{}{}
+			decode(t, w, &list)
+			if len(list) != 1 {
+				t.Fatalf("%v: expected one item, got %v", path, list)
+			}
+			item = list[0]
+		} else {
+			decode(t, w, &item)
+		}
+		// The Id is always there, even if it isn't asked for
+		if len(item) != 3 || item["Id"] != 1.0 || item["Name"] != "Buy milk" || item["Tags"] == nil {
+			t.Errorf("%v: expected only Id, Name and Tags, got %v", path, item)
+		}
+	}
+	expectStatus(t, request(r, http.MethodGet, "/api/TodoItems/1?fields=name,size", ""), http.StatusBadRequest)
+}
+
+func TestFieldsAndExcludeFieldsConflict(t *testing.T) {
+	_, r := newTestServer(t, nil)
+	createItem(t, r, `{"Name":"Buy milk"}`)
+	for _, path := range []string{"/api/TodoItems/1", "/api/TodoItems"} {
+		w := request(r, http.MethodGet, path+"?fields=Name&excludeFields=Tags", "")
+		expectStatus(t, w, http.StatusBadRequest)
+		if !strings.Contains(w.Body.String(), "can't be combined") {
+			t.Errorf("%v: expected the message to name the conflict, got %q", path, w.Body.String())
+		}
+	}
+}
+
+func TestOrderedItemsFollowTheRequest(t *testing.T) {
+	_, r := newTestServer(t, nil)
+	for _, name := range []string{"One", "Two", "Three"} {
+		createItem(t, r, `{"Name":"`+name+`"}`)
+	}
+
+	w := request(r, http.MethodPost, "/api/TodoItems/ordered", `{"Ids":[3,7,1,2,5]}`)
+	expectStatus(t, w, http.StatusOK)
+	result := OrderedItems{}
+	decode(t, w, &result)
+	ids := []int{}
+	for _, item := range result.Items {
+		ids = append(ids, item.Id)
+	}
+	if !reflect.DeepEqual(ids, []int{3, 1, 2}) {
+		t.Errorf("expected the items in the order [3 1 2], got %v", ids)
+	}
+	if !reflect.DeepEqual(result.Missing, []int{7, 5}) {
+		t.Errorf("expected the missing ids [7 5], got %v", result.Missing)
+	}
+}
+
+func TestFirstIncomplete(t *testing.T) {
+	_, r := newTestServer(t, nil)
+	expectStatus(t, request(r, http.MethodGet, "/api/TodoItems/first-incomplete", ""), http.StatusNotFound)
+
+	createItem(t, r, `{"Name":"Walk the dog"}`)
+	createItem(t, r, `{"Name":"Call mom"}`)
+	createItem(t, r, `{"Name":"Buy milk"}`)
+	expectStatus(t, request(r, http.MethodPost, "/api/TodoItems/1/toggle", ""), http.StatusOK)
+
+	first := func(path string) string {
+		t.Helper()
+		w := request(r, http.MethodGet, path, "")
+		expectStatus(t, w, http.StatusOK)
+		item := TodoItem{}
+		decode(t, w, &item)
+		return item.Name
+	}
+	// Item 1 is completed, so item 2 is next in id order
+	if name := first("/api/TodoItems/first-incomplete"); name != "Call mom" {
+		t.Errorf("expected Call mom first in id order, got %q", name)
+	}
+	if name := first("/api/TodoItems/first-incomplete?sort=name"); name != "Buy milk" {
+		t.Errorf("expected Buy milk first in name order, got %q", name)
+	}
+	// Only the items with the tag count, the same way as for the list
+	expectStatus(t, request(r, http.MethodPatch, "/api/TodoItems/3", `{"Tags":["Shopping"]}`), http.StatusOK)
+	if name := first("/api/TodoItems/first-incomplete?tag=shopping"); name != "Buy milk" {
+		t.Errorf("expected Buy milk first with the tag shopping, got %q", name)
+	}
+	expectStatus(t, request(r, http.MethodGet, "/api/TodoItems/first-incomplete?tag=work", ""), http.StatusNotFound)
+
+	expectStatus(t, request(r, http.MethodPost, "/api/TodoItems/2/toggle", ""), http.StatusOK)
+	expectStatus(t, request(r, http.MethodPost, "/api/TodoItems/3/toggle", ""), http.StatusOK)
+	expectStatus(t, request(r, http.MethodGet, "/api/TodoItems/first-incomplete", ""), http.StatusNotFound)
+}
+
+func TestAPIVersionHeaderMatchesVersion(t *testing.T) {
+	old := version
+	version = "1.2.3-test"
+	defer func() { version = old }()
+	_, r := newTestServer(t, nil)
+
+	w := request(r, http.MethodGet, "/version", "")
+	expectStatus(t, w, http.StatusOK)
+	body := map[string]string{}
+	decode(t, w, &body)
+	if body["version"] != "1.2.3-test" || w.Header().Get("X-API-Version") != body["version"] {
+		t.Errorf("expected the header and the body to show 1.2.3-test, got %q and %q", w.Header().Get("X-API-Version"), body["version"])
+	}
+	// Every response carries the header, including errors and the probes
+	for _, path := range []string{"/api/TodoItems/42", "/healthz"} {
+		if got := request(r, http.MethodGet, path, "").Header().Get("X-API-Version"); got != "1.2.3-test" {
+			t.Errorf("%v: expected the X-API-Version header 1.2.3-test, got %q", path, got)
+		}
+	}
+}
+
+func TestServerTimingHeader(t *testing.T) {
+	_, off := newTestServer(t, nil)
+	if got := request(off, http.MethodGet, "/api/TodoItems", "").Header().Get("Server-Timing"); got != "" {
+		t.Errorf("expected no Server-Timing header by default, got %q", got)
+	}
+
+	_, r := newTestServer(t, func(cfg *Config) {
+		cfg.ServerTiming = true
+		cfg.RateLimit, cfg.RateBurst = 1, 3
+	})
+	createItem(t, r, `{"Name":"Buy milk"}`)
+	format := regexp.MustCompile(`^handler;desc="Handler processing";dur=\d+\.\d{3}$`)
+	expectTiming := func(w *httptest.ResponseRecorder, what string) {
+		t.Helper()
+		if got := w.Header().Get("Server-Timing"); !format.MatchString(got) {
+			t.Errorf("%v: expected a well-formed Server-Timing header, got %q", what, got)
+		}
+	}
+	// The DELETE has no body, so the header is set after the handler instead of before the first write
+	for _, method := range []string{http.MethodGet, http.MethodDelete} {
+		w := request(r, method, "/api/TodoItems/1", "")
+		expectStatus(t, w, http.StatusOK)
+		expectTiming(w, method)
+	}
+	// The probes and the answer of the rate limit are outside of the item routes, but they are still timed
+	w := request(r, http.MethodGet, "/healthz", "")
+	expectStatus(t, w, http.StatusOK)
+	expectTiming(w, "the liveness probe")
+	w = request(r, http.MethodGet, "/api/TodoItems", "")
+	expectStatus(t, w, http.StatusTooManyRequests)
+	expectTiming(w, "the rate limit")
+}
+
+// A store whose writes fail while broken is set, like a database which went away.
+type brokenStore struct {
+	*memoryStore
+	broken bool
+}
+
+func (s *brokenStore) Create(item TodoItem) error {
+	if s.broken {
+		return errors.New("store is broken")
+	}
+	return s.memoryStore.Create(item)
+}
+
+func TestFailedSaveIsUndone(t *testing.T) {
+	th, r := newTestServer(t, nil)
+	store := &brokenStore{memoryStore: NewMemoryStore(), broken: true}
+	th.store = store
+
+	expectStatus(t, request(r, http.MethodPost, "/api/TodoItems", `{"Name":"Buy milk"}`), http.StatusInternalServerError)
+	expectStatus(t, request(r, http.MethodPost, "/api/TodoItems/bulk", `{"Creates":[{"Name":"Call mom"}]}`), http.StatusInternalServerError)
+	w := request(r, http.MethodGet, "/api/TodoItems", "")
+	if got := names(t, w); len(got) != 0 {
+		t.Errorf("expected the failed creates to be undone, got %v", got)
+	}
+
+	store.broken = false
+	createItem(t, r, `{"Name":"Pay rent"}`)
+	if list, _ := store.List(); len(list) != 1 || list[0].Name != "Pay rent" {
+		t.Errorf("expected only the successful create in the store, got %v", list)
+	}
+}
+
+func TestMergeDuplicatesCreatesNoCycles(t *testing.T) {
+	_, r := newTestServer(t, nil)
+	createItem(t, r, `{"Name":"Buy paint"}`)
+	createItem(t, r, `{"Name":"buy  paint"}`)
+	createItem(t, r, `{"Name":"Paint the fence"}`)
+	createItem(t, r, `{"Name":"Sand the fence"}`)
+	createItem(t, r, `{"Name":"sand the fence"}`)
+	// Item 1 depends on its own duplicate. Item 3 depends on the duplicate 5 while the survivor 4 depends on item 3.
+	expectStatus(t, request(r, http.MethodPatch, "/api/TodoItems/1", `{"DependsOn":[2]}`), http.StatusOK)
+	expectStatus(t, request(r, http.MethodPatch, "/api/TodoItems/3", `{"DependsOn":[5]}`), http.StatusOK)
+	expectStatus(t, request(r, http.MethodPatch, "/api/TodoItems/4", `{"DependsOn":[3]}`), http.StatusOK)
+
+	expectStatus(t, request(r, http.MethodPost, "/api/TodoItems/merge-duplicates", ""), http.StatusOK)
+	w := request(r, http.MethodGet, "/api/TodoItems/graph", "")
+	graph := Graph{}
+	decode(t, w, &graph)
+	if len(graph.Cycles) != 0 {
+		t.Errorf("expected no cycles after the merge, got %v", graph.Cycles)
+	}
+	if expected := []GraphEdge{{From: 4, To: 3}}; !reflect.DeepEqual(graph.Edges, expected) {
+		t.Errorf("expected the edges %v, got %v", expected, graph.Edges)
+	}
+}
+
+func TestDuplicatesAreGroupedByName(t *testing.T) {
+	_, r := newTestServer(t, nil)
+	createItem(t, r, `{"Name":"Buy paint"}`)
+	createItem(t, r, `{"Name":"Call mom"}`)
+	createItem(t, r, `{"Name":" buy  PAINT "}`)
+	createItem(t, r, `{"Name":"call mom"}`)
+	createItem(t, r, `{"Name":"Pay rent"}`)
+
+	w := request(r, http.MethodGet, "/api/TodoItems/duplicates", "")
+	expectStatus(t, w, http.StatusOK)
+	groups := []TodoItemCollection{}
+	decode(t, w, &groups)
+	ids := [][]int{}
+	for _, group := range groups {
+		groupIDs := []int{}
+		for _, item := range group {
+			groupIDs = append(groupIDs, item.Id)
+		}
+		ids = append(ids, groupIDs)
+	}
+	if expected := [][]int{{1, 3}, {2, 4}}; !reflect.DeepEqual(ids, expected) {
+		t.Errorf("expected the groups %v, got %v", expected, ids)
+	}
+}
+
+func TestMergeDuplicatesKeepsTheOldest(t *testing.T) {
+	th, r := newTestServer(t, nil)
+	clock := &fakeClock{now: time.Date(2021, 3, 1, 9, 0, 0, 0, time.UTC)}
+	th.clock = clock
+	createItem(t, r, `{"Name":"Buy paint","Tags":["home"]}`)
+	clock.now = clock.now.Add(time.Hour)
+	createItem(t, r, `{"Name":"buy paint","Tags":["shopping","home"]}`)
+	createItem(t, r, `{"Name":"BUY PAINT","Tags":["urgent"]}`)
+	createItem(t, r, `{"Name":"Call mom"}`)
+	createItem(t, r, `{"Name":"call mom"}`)
+	createItem(t, r, `{"Name":"Pay rent"}`)
+
+	w := request(r, http.MethodPost, "/api/TodoItems/merge-duplicates", "")
+	expectStatus(t, w, http.StatusOK)
+	result := MergeResult{}
+	decode(t, w, &result)
+	if result.Merged != 3 {
+		t.Errorf("expected 3 merged items, got %v", result.Merged)
+	}
+
+	w = request(r, http.MethodGet, "/api/TodoItems", "")
+	items := TodoItemCollection{}
+	decode(t, w, &items)
+	ids := []int{}
+	for _, item := range items {
+		ids = append(ids, item.Id)
+	}
+	if !reflect.DeepEqual(ids, []int{1, 4, 6}) {
+		t.Fatalf("expected one survivor per group and the unique item, got %v", ids)
+	}
+	survivor := items[0]
+	if !reflect.DeepEqual(survivor.Tags, []string{"home", "shopping", "urgent"}) {
+		t.Errorf("expected the survivor to have the tags of all duplicates, got %v", survivor.Tags)
+	}
+	if expected := time.Date(2021, 3, 1, 9, 0, 0, 0, time.UTC); !survivor.CreatedAt.Equal(expected) {
+		t.Errorf("expected the survivor to keep its CreatedAt %v, got %v", expected, survivor.CreatedAt)
+	}
+	w = request(r, http.MethodGet, "/api/TodoItems/duplicates", "")
+	if strings.TrimSpace(w.Body.String()) != "[]" {
+		t.Errorf("expected no duplicates after the merge, got %v", w.Body.String())
+	}
+}
+
+func TestMergedTagsAreCapped(t *testing.T) {
+	_, r := newTestServer(t, nil)
+	createItem(t, r, `{"Name":"Buy paint","Tags":["a","b","c","d","e","f"]}`)
+	createItem(t, r, `{"Name":"buy paint","Tags":["g","h","i","j","k","l"]}`)
+
+	expectStatus(t, request(r, http.MethodPost, "/api/TodoItems/merge-duplicates", ""), http.StatusOK)
+	w := request(r, http.MethodGet, "/api/TodoItems/1", "")
+	expectStatus(t, w, http.StatusOK)
+	item := TodoItem{}
+	decode(t, w, &item)
+	if expected := []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j"}; !reflect.DeepEqual(item.Tags, expected) {
+		t.Errorf("expected the tags to stop at %v, got %v", maxTags, item.Tags)
+	}
+}
+
+func TestMergedItemIsOnlyCompleteIfAllAre(t *testing.T) {
+	_, r := newTestServer(t, nil)
+	createItem(t, r, `{"Name":"Buy paint"}`)
+	createItem(t, r, `{"Name":"buy paint"}`)
+	createItem(t, r, `{"Name":"Call mom"}`)
+	createItem(t, r, `{"Name":"call mom"}`)
+	// The survivor of the first group is complete but its duplicate is open. Both items of the second group are complete.
+	for _, id := range []string{"1", "3", "4"} {
+		expectStatus(t, request(r, http.MethodPost, "/api/TodoItems/"+id+"/toggle", ""), http.StatusOK)
+	}
+
+	expectStatus(t, request(r, http.MethodPost, "/api/TodoItems/merge-duplicates", ""), http.StatusOK)
+	item := TodoItem{}
+	decode(t, request(r, http.MethodGet, "/api/TodoItems/1", ""), &item)
+	if item.IsComplete || item.CompletedAt != nil {
+		t.Errorf("expected the survivor of an open duplicate to be open, got %v %v", item.IsComplete, item.CompletedAt)
+	}
+	item = TodoItem{}
+	decode(t, request(r, http.MethodGet, "/api/TodoItems/3", ""), &item)
+	if !item.IsComplete || item.CompletedAt == nil {
+		t.Errorf("expected the survivor of completed duplicates to stay complete, got %v %v", item.IsComplete, item.CompletedAt)
+	}
+}
+
+func TestVersionGoesUpWithEveryChange(t *testing.T) {
+	_, r := newTestServer(t, nil)
+	item := createItem(t, r, `{"Name":"Buy milk"}`)
+	if item.Version != 1 {
+		t.Fatalf("expected a new item to have version 1, got %v", item.Version)
+	}
+	w := request(r, http.MethodPatch, "/api/TodoItems/1", `{"Name":"Buy oat milk"}`)
+	expectStatus(t, w, http.StatusOK)
+	decode(t, w, &item)
+	if item.Version != 2 || w.Header().Get("ETag") != `"2"` {
+		t.Fatalf("expected version 2 and the ETag \"2\", got %v and %v", item.Version, w.Header().Get("ETag"))
+	}
+	w = request(r, http.MethodPost, "/api/TodoItems/1/toggle", "")
+	expectStatus(t, w, http.StatusOK)
+	decode(t, w, &item)
+	if item.Version != 3 {
+		t.Errorf("expected version 3 after the toggle, got %v", item.Version)
+	}
+}
+
+func TestStaleIfMatchIsRejected(t *testing.T) {
+	_, r := newTestServer(t, nil)
+	createItem(t, r, `{"Name":"Buy milk"}`)
+	createItem(t, r, `{"Name":"Call mom"}`)
+	expectStatus(t, request(r, http.MethodPatch, "/api/TodoItems/1", `{"Name":"Buy oat milk"}`), http.StatusOK)
+
+	// Every write route checks If-Match against the current version, which is 2 now
+	writes := []struct{ method, path, body string }{
+		{http.MethodPut, "/api/TodoItems/1", `{"Name":"Buy soy milk"}`},
+		{http.MethodPatch, "/api/TodoItems/1", `{"Name":"Buy soy milk"}`},
+		{http.MethodPost, "/api/TodoItems/1/toggle", ""},
+		{http.MethodPost, "/api/TodoItems/1/move", `{"After":2}`},
+		{http.MethodDelete, "/api/TodoItems/1", ""},
+	}
+	for _, write := range writes {
+		w := request(r, write.method, write.path, write.body, "If-Match", `"1"`)
+		expectStatus(t, w, http.StatusPreconditionFailed)
+		if w.Header().Get("ETag") != `"2"` {
+			t.Errorf("%v %v: expected the current ETag \"2\", got %v", write.method, write.path, w.Header().Get("ETag"))
+		}
+	}
+	item := TodoItem{}
+	decode(t, request(r, http.MethodGet, "/api/TodoItems/1", ""), &item)
+	if item.Name != "Buy oat milk" || item.Version != 2 {
+		t.Fatalf("expected the rejected writes to change nothing, got %v", item)
+	}
+
+	// A weak tag never matches, the current tag does
+	expectStatus(t, request(r, http.MethodPut, "/api/TodoItems/1", `{"Name":"Buy soy milk"}`, "If-Match", `W/"2"`), http.StatusPreconditionFailed)
+	expectStatus(t, request(r, http.MethodPut, "/api/TodoItems/1", `{"Name":"Buy soy milk"}`, "If-Match", `"2"`), http.StatusOK)
+}
+
+func TestIfNoneMatchReturnsNotModified(t *testing.T) {
+	_, r := newTestServer(t, nil)
+	createItem(t, r, `{"Name":"Buy milk"}`)
+
+	w := request(r, http.MethodGet, "/api/TodoItems/1", "", "If-None-Match", `"1"`)
+	expectStatus(t, w, http.StatusNotModified)
+	if w.Body.Len() != 0 {
+		t.Errorf("expected a 304 without a body, got %q", w.Body.String())
+	}
+	expectStatus(t, request(r, http.MethodGet, "/api/TodoItems/1", "", "If-None-Match", `"0", W/"1"`), http.StatusNotModified)
+
+	expectStatus(t, request(r, http.MethodPatch, "/api/TodoItems/1", `{"Name":"Buy oat milk"}`), http.StatusOK)
+	w = request(r, http.MethodGet, "/api/TodoItems/1", "", "If-None-Match", `"1"`)
+	expectStatus(t, w, http.StatusOK)
+	if w.Header().Get("ETag") != `"2"` {
+		t.Errorf("expected the new ETag \"2\", got %v", w.Header().Get("ETag"))
+	}
+}
+
+func TestRebalanceKeepsTheETag(t *testing.T) {
+	th, r := newTestServer(t, func(cfg *Config) { cfg.AdminAPIKey = "admin key" })
+	for _, name := range []string{"One", "Two", "Three"} {
+		createItem(t, r, `{"Name":"`+name+`"}`)
+	}
+	expectStatus(t, request(r, http.MethodDelete, "/api/TodoItems/2", ""), http.StatusOK)
+	before := request(r, http.MethodGet, "/api/TodoItems/3", "").Header().Get("ETag")
+
+	expectStatus(t, request(r, http.MethodPost, "/api/admin/normalize-positions", "", "X-API-Key", "admin key"), http.StatusOK)
+	if th.items[3].Position != 2*positionGap {
+		t.Fatalf("expected the rebalance to move item 3 to %v, got %v", 2*positionGap, th.items[3].Position)
+	}
+	w := request(r, http.MethodGet, "/api/TodoItems/3", "")
+	if after := w.Header().Get("ETag"); after != before {
+		t.Errorf("expected the rebalance to keep the ETag %v, got %v", before, after)
+	}
+	expectStatus(t, request(r, http.MethodPatch, "/api/TodoItems/3", `{"Name":"Three!"}`, "If-Match", before), http.StatusOK)
+}
+
+func TestUsersOnlySeeTheirOwnItems(t *testing.T) {
+	_, r := newTestServer(t, func(cfg *Config) { cfg.Auth, cfg.JWTSecret = true, "test secret" })
+	alice, bob := "Bearer "+login(t, r, "alice"), "Bearer "+login(t, r, "bob")
+	expectStatus(t, request(r, http.MethodPost, "/api/TodoItems", `{"Name":"Buy milk"}`, "Authorization", alice), http.StatusCreated)
+
+	// The item of alice looks to bob as if it didn't exist
+	writes := []struct{ method, path, body string }{
+		{http.MethodGet, "/api/TodoItems/1", ""},
+		{http.MethodPut, "/api/TodoItems/1", `{"Name":"Buy beer"}`},
+		{http.MethodPatch, "/api/TodoItems/1", `{"Name":"Buy beer"}`},
+		{http.MethodPost, "/api/TodoItems/1/toggle", ""},
+		{http.MethodDelete, "/api/TodoItems/1", ""},
+	}
+	for _, write := range writes {
+		w := request(r, write.method, write.path, write.body, "Authorization", bob)
+		expectStatus(t, w, http.StatusNotFound)
+	}
+	w := request(r, http.MethodGet, "/api/TodoItems", "", "Authorization", bob)
+	expectStatus(t, w, http.StatusOK)
+	if got := names(t, w); len(got) != 0 {
+		t.Errorf("expected bob to see no items, got %v", got)
+	}
+
+	w = request(r, http.MethodGet, "/api/TodoItems/1", "", "Authorization", alice)
+	expectStatus(t, w, http.StatusOK)
+	item := TodoItem{}
+	decode(t, w, &item)
+	if item.Name != "Buy milk" || item.IsComplete || item.Owner != "alice" {
+		t.Errorf("expected the item of alice to stay unchanged, got %v", item)
+	}
+	expectStatus(t, request(r, http.MethodGet, "/api/TodoItems/1", ""), http.StatusUnauthorized)
+}
+
+// Registers an admin with the api key and returns the Authorization header of a token for them.
+func loginAdmin(t *testing.T, r http.Handler, username, apiKey string) string {
+	t.Helper()
+	credentials := `{"Username":"` + username + `","Password":"correct horse"}`
+	expectStatus(t, request(r, http.MethodPost, "/api/users/register", credentials), http.StatusForbidden)
+	expectStatus(t, request(r, http.MethodPost, "/api/users/register", credentials, "X-API-Key", apiKey), http.StatusCreated)
+	w := request(r, http.MethodPost, "/api/users/login", credentials)
+	expectStatus(t, w, http.StatusOK)
+	result := LoginResult{}
+	decode(t, w, &result)
+	return "Bearer " + result.Token
+}
+
+func TestOnlyAdminsListAllItems(t *testing.T) {
+	_, r := newTestServer(t, func(cfg *Config) {
+		cfg.Auth, cfg.JWTSecret = true, "test secret"
+		cfg.AdminUsers, cfg.AdminAPIKey = "root", "admin key"
+	})
+	alice, bob := "Bearer "+login(t, r, "alice"), "Bearer "+login(t, r, "bob")
+	root := loginAdmin(t, r, "root", "admin key")
+	expectStatus(t, request(r, http.MethodPost, "/api/TodoItems", `{"Name":"Buy milk"}`, "Authorization", alice), http.StatusCreated)
+	expectStatus(t, request(r, http.MethodPost, "/api/TodoItems", `{"Name":"Call mom"}`, "Authorization", bob), http.StatusCreated)
+
+	expectStatus(t, request(r, http.MethodGet, "/api/TodoItems?all=true", "", "Authorization", bob), http.StatusForbidden)
+	w := request(r, http.MethodGet, "/api/TodoItems?all=true", "", "Authorization", root)
+	expectStatus(t, w, http.StatusOK)
+	if got := names(t, w); !reflect.DeepEqual(got, []string{"Buy milk", "Call mom"}) {
+		t.Errorf("expected the admin to see the items of all users, got %v", got)
+	}
+	w = request(r, http.MethodGet, "/api/TodoItems", "", "Authorization", root)
+	if got := names(t, w); len(got) != 0 {
+		t.Errorf("expected the admin to see only their own items without all, got %v", got)
+	}
+}
+
+func TestRemovedAdminsLoseTheirRights(t *testing.T) {
+	dir, err := ioutil.TempDir("", "todo-users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configure := func(admins string) func(cfg *Config) {
+		return func(cfg *Config) {
+			cfg.Auth, cfg.JWTSecret, cfg.UsersFile = true, "test secret", filepath.Join(dir, "users.json")
+			cfg.AdminUsers, cfg.AdminAPIKey = admins, "admin key"
+		}
+	}
+	_, r := newTestServer(t, configure("root"))
+	root := loginAdmin(t, r, "root", "admin key")
+	expectStatus(t, request(r, http.MethodGet, "/api/TodoItems?all=true", "", "Authorization", root), http.StatusOK)
+
+	// After a restart without root in TODO_ADMIN_USERS the old token still says admin, but it's not trusted anymore
+	_, r = newTestServer(t, configure(""))
+	expectStatus(t, request(r, http.MethodGet, "/api/TodoItems", "", "Authorization", root), http.StatusOK)
+	expectStatus(t, request(r, http.MethodGet, "/api/TodoItems?all=true", "", "Authorization", root), http.StatusForbidden)
+}
+
+func TestImportReportsEveryInvalidRow(t *testing.T) {
+	_, r := newTestServer(t, nil)
+	// The header is row 1, so the broken rows are 3 and 4
+	csv := "Name,EstimateMinutes,Priority\nBuy milk,5,low\nCall mom,soon,\n ,10,high\nPay rent,,high\n"
+	w := request(r, http.MethodPost, "/api/TodoItems/import?format=csv", csv)
+	expectStatus(t, w, http.StatusUnprocessableEntity)
+	result := ImportResult{}
+	decode(t, w, &result)
+	rows := []int{}
+	for _, err := range result.Errors {
+		rows = append(rows, err.Row)
+	}
+	if !reflect.DeepEqual(rows, []int{3, 4}) || result.Imported != 0 {
+		t.Errorf("expected errors in the rows [3 4] and nothing imported, got %v and %v", result.Errors, result.Imported)
+	}
+	w = request(r, http.MethodGet, "/api/TodoItems", "")
+	if got := names(t, w); len(got) != 0 {
+		t.Errorf("expected nothing to be imported, got %v", got)
+	}
+
+	// In JSON the first item is row 1
+	w = request(r, http.MethodPost, "/api/TodoItems/import", `[{"Name":"Buy milk"},{"Name":"Call mom","EstimateMinutes":-1}]`)
+	expectStatus(t, w, http.StatusUnprocessableEntity)
+	result = ImportResult{}
+	decode(t, w, &result)
+	if len(result.Errors) != 1 || result.Errors[0].Row != 2 {
+		t.Errorf("expected one error in row 2, got %v", result.Errors)
+	}
+}
+
+func TestImportCanSkipInvalidRows(t *testing.T) {
+	_, r := newTestServer(t, nil)
+	csv := "Name,EstimateMinutes\nBuy milk,5\nCall mom,soon\nPay rent,\n"
+	w := request(r, http.MethodPost, "/api/TodoItems/import?format=csv&skipInvalid=true", csv)
+	expectStatus(t, w, http.StatusCreated)
+	result := ImportResult{}
+	decode(t, w, &result)
+	if result.Imported != 2 || len(result.Errors) != 1 || result.Errors[0].Row != 3 {
+		t.Errorf("expected 2 imported items and an error in row 3, got %v", result)
+	}
+	w = request(r, http.MethodGet, "/api/TodoItems", "")
+	if got := names(t, w); !reflect.DeepEqual(got, []string{"Buy milk", "Pay rent"}) {
+		t.Errorf("expected only the valid rows to be imported, got %v", got)
+	}
+}
+
+func TestExportCanBeImportedAgain(t *testing.T) {
+	for _, format := range []string{"csv", "json"} {
+		t.Run(format, func(t *testing.T) {
+			_, r := newTestServer(t, nil)
+			createItem(t, r, `{"Name":"Buy milk, eggs","EstimateMinutes":5,"Priority":"high","Tags":["shopping","home"]}`)
+			createItem(t, r, `{"Name":"Call \"mom\"","DueDate":"2099-01-02T15:04:05Z"}`)
+			expectStatus(t, request(r, http.MethodPost, "/api/TodoItems/2/toggle", ""), http.StatusOK)
+
+			w := request(r, http.MethodGet, "/api/TodoItems/export?format="+format, "")
+			expectStatus(t, w, http.StatusOK)
+			if disposition := w.Header().Get("Content-Disposition"); !strings.Contains(disposition, "todos."+format) {
+				t.Errorf("expected a download of todos.%v, got %q", format, disposition)
+			}
+
+			_, other := newTestServer(t, nil)
+			expectStatus(t, request(other, http.MethodPost, "/api/TodoItems/import?format="+format, w.Body.String()), http.StatusCreated)
+			exported, imported := TodoItemCollection{}, TodoItemCollection{}
+			decode(t, request(r, http.MethodGet, "/api/TodoItems", ""), &exported)
+			decode(t, request(other, http.MethodGet, "/api/TodoItems", ""), &imported)
+			if len(imported) != len(exported) {
+				t.Fatalf("expected %v imported items, got %v", len(exported), imported)
+			}
+			for i := range exported {
+				a, b := exported[i], imported[i]
+				if a.Name != b.Name || a.IsComplete != b.IsComplete || a.Priority != b.Priority || !reflect.DeepEqual(a.Tags, b.Tags) ||
+					!reflect.DeepEqual(a.EstimateMinutes, b.EstimateMinutes) || (a.DueDate == nil) != (b.DueDate == nil) ||
+					(a.DueDate != nil && !a.DueDate.Equal(*b.DueDate)) {
+					t.Errorf("expected the imported item %v to match the exported %v", b, a)
+				}
+			}
+		})
+	}
+}
+
+func TestImportRespectsOpenItemsLimit(t *testing.T) {
+	_, r := newTestServer(t, func(cfg *Config) { cfg.MaxOpenItems = 2 })
+	createItem(t, r, `{"Name":"Buy milk"}`)
+
+	w := request(r, http.MethodPost, "/api/TodoItems/import", `[{"Name":"Call mom"},{"Name":"Pay rent"}]`)
+	expectStatus(t, w, http.StatusConflict)
+	w = request(r, http.MethodGet, "/api/TodoItems", "")
+	if got := names(t, w); !reflect.DeepEqual(got, []string{"Buy milk"}) {
+		t.Errorf("expected nothing to be imported, got %v", got)
+	}
+	// Completed items don't count
+	expectStatus(t, request(r, http.MethodPost, "/api/TodoItems/import", `[{"Name":"Call mom"},{"Name":"Pay rent","IsComplete":true}]`), http.StatusCreated)
+}
+
+// An ItemPage with the items decoded.
+type itemPage struct {
+	Items    TodoItemCollection
+	Total    int
+	Page     int
+	PageSize int
+	Next     *string
+	Prev     *string
+}
+
+// Fetches a page of the list and checks its items and links. Empty links are expected to be null.
+func expectPage(t *testing.T, r http.Handler, path string, ids []int, next, prev string) itemPage {
+	t.Helper()
+	w := request(r, http.MethodGet, path, "")
+	expectStatus(t, w, http.StatusOK)
+	page := itemPage{}
+	decode(t, w, &page)
+	got := []int{}
+	for _, item := range page.Items {
+		got = append(got, item.Id)
+	}
+	if !reflect.DeepEqual(got, ids) {
+		t.Errorf("%v: expected the items %v, got %v", path, ids, got)
+	}
+	link := func(l *string) string {
+		if l == nil {
+			return ""
+		}
+		return *l
+	}
+	if link(page.Next) != next || link(page.Prev) != prev {
+		t.Errorf("%v: expected the links %q and %q, got %q and %q", path, next, prev, link(page.Next), link(page.Prev))
+	}
+	return page
+}
+
+func TestPagesLinkToTheirNeighbours(t *testing.T) {
+	_, r := newTestServer(t, nil)
+	for _, name := range []string{"One", "Two", "Three", "Four", "Five"} {
+		createItem(t, r, `{"Name":"`+name+`"}`)
+	}
+
+	page := expectPage(t, r, "/api/TodoItems?page=1&pageSize=2", []int{1, 2}, "/api/TodoItems?page=2&pageSize=2", "")
+	if page.Total != 5 || page.Page != 1 || page.PageSize != 2 {
+		t.Errorf("expected total 5, page 1 and page size 2, got %v, %v and %v", page.Total, page.Page, page.PageSize)
+	}
+	expectPage(t, r, "/api/TodoItems?page=2&pageSize=2", []int{3, 4}, "/api/TodoItems?page=3&pageSize=2", "/api/TodoItems?page=1&pageSize=2")
+	// The last page is shorter and has no next page
+	expectPage(t, r, "/api/TodoItems?page=3&pageSize=2", []int{5}, "", "/api/TodoItems?page=2&pageSize=2")
+	// Past the end the page is empty and points back to the last page
+	page = expectPage(t, r, "/api/TodoItems?page=9&pageSize=2", []int{}, "", "/api/TodoItems?page=3&pageSize=2")
+	if page.Total != 5 {
+		t.Errorf("expected the total to count all items, got %v", page.Total)
+	}
+	// Without pageSize the default size is used
+	expectPage(t, r, "/api/TodoItems?page=1", []int{1, 2, 3, 4, 5}, "", "")
+}
+
+func TestPagesKeepSortAndSearch(t *testing.T) {
+	_, r := newTestServer(t, nil)
+	for _, name := range []string{"Buy milk", "Call mom", "Buy oat milk", "Milk the cow"} {
+		createItem(t, r, `{"Name":"`+name+`"}`)
+	}
+
+	// Three items match, in descending order of their names they are 4, 3 and 1
+	page := expectPage(t, r, "/api/TodoItems?q=MILK&sort=name&order=desc&page=2&pageSize=1", []int{3},
+		"/api/TodoItems?order=desc&page=3&pageSize=1&q=MILK&sort=name", "/api/TodoItems?order=desc&page=1&pageSize=1&q=MILK&sort=name")
+	if page.Total != 3 {
+		t.Errorf("expected the total to count only the matching items, got %v", page.Total)
+	}
+	expectPage(t, r, "/api/TodoItems?order=desc&page=3&pageSize=1&q=MILK&sort=name", []int{1}, "", "/api/TodoItems?order=desc&page=2&pageSize=1&q=MILK&sort=name")
+}
+
+func TestInvalidPagesAreRejected(t *testing.T) {
+	_, r := newTestServer(t, nil)
+	for _, query := range []string{"page=0", "pageSize=0", "pageSize=101", "page=x", "page=1&offset=2", "pageSize=5&limit=2"} {
+		expectStatus(t, request(r, http.MethodGet, "/api/TodoItems?"+query, ""), http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ServerTiming returns a Gin middleware which reports how long the request took inside our handlers using the Server-Timing header.
+// Browsers show this value in the network tab of their devtools, which makes it easy to spot slow endpoints from the client side.
+func ServerTiming() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		w := &serverTimingWriter{ResponseWriter: c.Writer, start: time.Now()}
+		c.Writer = w
+		c.Next()
+		// Handlers without a body (e.g. a plain 200) never call Write, so we set the header here before Gin flushes the status line.
+		if !w.Written() {
+			w.setHeader()
+		}
+	}
+}
+
+// Headers can only be changed before the first byte of the body is sent. That's why we wrap Gin's ResponseWriter and add our
+// header right before the body gets written instead of after the handler has returned.
+type serverTimingWriter struct {
+	gin.ResponseWriter
+	start time.Time
+	done  bool
+}
+
+func (w *serverTimingWriter) setHeader() {
+	if w.done {
+		return
+	}
+	w.done = true
+	dur := float64(time.Since(w.start).Microseconds()) / 1000
+	w.Header().Set("Server-Timing", fmt.Sprintf(`handler;desc="Handler processing";dur=%.3f`, dur))
+}
+
+func (w *serverTimingWriter) WriteHeaderNow() {
+	w.setHeader()
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *serverTimingWriter) Write(data []byte) (int, error) {
+	w.setHeader()
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *serverTimingWriter) WriteString(s string) (int, error) {
+	w.setHeader()
+	return w.ResponseWriter.WriteString(s)
+}
+
+// APIVersion returns a Gin middleware which adds the X-API-Version header to every response.
+func APIVersion(version string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("X-API-Version", version)
+		c.Next()
+	}
+}
+
+// AdminAuth returns a Gin middleware which only lets requests through that send the given key in the X-API-Key header.
+// Without a key the admin routes are switched off, so they are never open by accident.
+func AdminAuth(key string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if key == "" {
+			c.String(http.StatusForbidden, "Forbidden: The admin routes are switched off, set TODO_ADMIN_API_KEY to use them")
+			c.Abort()
+			return
+		}
+		if !validAPIKey(c, key) {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		c.Next()
+	}
+}
+
+// Reports whether the request sends the given key in the X-API-Key header. An empty key never matches.
+func validAPIKey(c *gin.Context, key string) bool {
+	// A constant time compare doesn't reveal how many characters of a guessed key were right
+	return key != "" && subtle.ConstantTimeCompare([]byte(c.GetHeader("X-API-Key")), []byte(key)) == 1
+}
+
+// The key of the request id in the Gin context.
+const requestIDKey = "requestID"
+
+// Ids sent by clients or proxies are only taken over if they look harmless, as they end up in our logs.
+var requestIDPattern = regexp.MustCompile(`^[a-zA-Z0-9_.:-]{1,64}$`)
+
+// RequestID returns a Gin middleware which gives every request an id and sends it back in the X-Request-ID header. An id sent by
+// the client, usually set by a proxy in front of us, is kept, so the same id shows up in the logs of all services.
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader("X-Request-ID")
+		if !requestIDPattern.MatchString(id) {
+			b := make([]byte, 16)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+		c.Set(requestIDKey, id)
+		c.Header("X-Request-ID", id)
+		c.Next()
+	}
+}
+
+// One line of the request log.
+type requestLogEntry struct {
+	Time       time.Time `json:"time"`
+	Level      string    `json:"level"`
+	Msg        string    `json:"msg"`
+	RequestID  string    `json:"requestId,omitempty"`
+	TraceID    string    `json:"traceId,omitempty"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Status     int       `json:"status"`
+	DurationMs float64   `json:"durationMs"`
+	Bytes      int       `json:"bytes"`
+	ClientIP   string    `json:"clientIp"`
+	User       string    `json:"user,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// StructuredLogger returns a Gin middleware which logs every request as one line of JSON instead of Gin's text format, so log
+// collectors can filter by fields like the status or the request id.
+func StructuredLogger() gin.HandlerFunc {
+	logger := log.New(os.Stdout, "", 0)
+	return func(c *gin.Context) {
+		start := time.Now()
+		path := c.Request.URL.Path
+		c.Next()
+
+		entry := requestLogEntry{
+			Time:       start.UTC(),
+			Level:      "info",
+			Msg:        "request",
+			RequestID:  c.GetString(requestIDKey),
+			TraceID:    c.GetString(traceIDKey),
+			Method:     c.Request.Method,
+			Path:       path,
+			Status:     c.Writer.Status(),
+			DurationMs: float64(time.Since(start).Microseconds()) / 1000,
+			Bytes:      c.Writer.Size(),
+			ClientIP:   c.ClientIP(),
+			User:       ownerOf(c),
+			Error:      c.Errors.ByType(gin.ErrorTypePrivate).String(),
+		}
+		switch {
+		case entry.Status >= 500:
+			entry.Level = "error"
+		case entry.Status >= 400:
+			entry.Level = "warn"
+		}
+		// A body which was never written has the size -1
+		if entry.Bytes < 0 {
+			entry.Bytes = 0
+		}
+		line, _ := json.Marshal(entry)
+		logger.Println(string(line))
+	}
+}
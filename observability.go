@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Endpoints and middlewares for running the service in production: health checks for the orchestrator, metrics for Prometheus
+// and traces for OpenTelemetry.
+
+// The state of a health check.
+type HealthStatus struct {
+	Status string
+	Error  string `json:",omitempty"`
+}
+
+// Liveness probe. If the process can answer at all it's alive, so this never checks anything else. A failing database must not
+// get the service restarted, that's what the readiness probe is for.
+func Healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, HealthStatus{Status: "ok"})
+}
+
+// Stores which can tell whether they are usable right now implement this interface. Stores without it are always ready.
+type pingStore interface {
+	Ping(ctx context.Context) error
+}
+
+// Returns the readiness probe. The service is ready as long as its store answers, otherwise it's taken out of the load balancer
+// until the store is back.
+func Readyz(store TodoStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if ps, ok := store.(pingStore); ok {
+			ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+			defer cancel()
+			if err := ps.Ping(ctx); err != nil {
+				c.JSON(http.StatusServiceUnavailable, HealthStatus{Status: "unavailable", Error: err.Error()})
+				return
+			}
+		}
+		c.JSON(http.StatusOK, HealthStatus{Status: "ok"})
+	}
+}
+
+func (s *sqlStore) Ping(ctx context.Context) error {
+	if db, ok := s.db.(interface{ PingContext(context.Context) error }); ok {
+		return db.PingContext(ctx)
+	}
+	return nil
+}
+
+// The file store is ready as long as the directory of the file exists, as the file itself is created with the first change.
+func (s *jsonFileStore) Ping(ctx context.Context) error {
+	_, err := os.Stat(filepath.Dir(s.path))
+	return err
+}
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "todo_http_requests_total",
+		Help: "Number of HTTP requests by method, route and status code.",
+	}, []string{"method", "route", "status"})
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "todo_http_request_duration_seconds",
+		Help:    "Duration of HTTP requests by method and route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+)
+
+// Metrics returns a Gin middleware which counts the requests and measures their duration. We use the route pattern like
+// /api/TodoItems/:id instead of the path as label, otherwise every id would create its own time series.
+func Metrics() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		httpRequests.WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).Inc()
+		httpDuration.WithLabelValues(c.Request.Method, route).Observe(time.Since(start).Seconds())
+	}
+}
+
+// Returns the handler for /metrics. Besides the request metrics and the default metrics of the Go runtime it reports the number
+// of open and completed items, which are counted when Prometheus scrapes them.
+func (th *TodoHandler) MetricsHandler() gin.HandlerFunc {
+	registry := prometheus.NewRegistry()
+	count := func(complete bool) func() float64 {
+		return func() float64 {
+			th.RLock()
+			defer th.RUnlock()
+			n := 0
+			for _, item := range th.items {
+				if item.IsComplete == complete {
+					n++
+				}
+			}
+			return float64(n)
+		}
+	}
+	registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		httpRequests,
+		httpDuration,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "todo_items",
+			Help:        "Number of todo items by state.",
+			ConstLabels: prometheus.Labels{"state": "open"},
+		}, count(false)),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "todo_items",
+			Help:        "Number of todo items by state.",
+			ConstLabels: prometheus.Labels{"state": "completed"},
+		}, count(true)),
+	)
+	return gin.WrapH(promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+}
+
+// The key of the trace id in the Gin context, so the request log can show it.
+const traceIDKey = "traceID"
+
+// Sets up OpenTelemetry and returns the tracing middlewares and a function which sends the remaining spans on shutdown.
+// The spans are exported using OTLP over HTTP. Where to is configured with the standard OTEL_EXPORTER_OTLP_ENDPOINT variable.
+// A traceparent header sent by a gateway in front of us is continued, so our spans show up in the same trace.
+func NewTracing(serviceName string) ([]gin.HandlerFunc, func(context.Context) error, error) {
+	exporter, err := otlptracehttp.New(context.Background())
+	if err != nil {
+		return nil, nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceNameKey.String(serviceName),
+			semconv.ServiceVersionKey.String(version),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	// otelgin puts the span into the request context only while the request runs, so we copy its id into the Gin context
+	traceID := func(c *gin.Context) {
+		if span := trace.SpanContextFromContext(c.Request.Context()); span.HasTraceID() {
+			c.Set(traceIDKey, span.TraceID().String())
+		}
+		c.Next()
+	}
+	return []gin.HandlerFunc{otelgin.Middleware(serviceName), traceID}, provider.Shutdown, nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Items are ordered by their Position. Positions are spread out with big gaps, so moving an item between two others only needs the
+// midpoint of their positions instead of renumbering the whole list. When the gap between two neighbours becomes too small for
+// another midpoint, all positions get spread out again.
+const positionGap = 1024.0
+
+// Sorts items by position and uses the id as tie breaker so the order is always the same.
+type byPosition TodoItemCollection
+
+func (t byPosition) Len() int      { return len(t) }
+func (t byPosition) Swap(i, j int) { t[i], t[j] = t[j], t[i] }
+func (t byPosition) Less(i, j int) bool {
+	if t[i].Position != t[j].Position {
+		return t[i].Position < t[j].Position
+	}
+	return t[i].Id < t[j].Id
+}
+
+// Returns all items in position order. The caller needs to hold the lock.
+func (th *TodoHandler) itemsByPosition() TodoItemCollection {
+	items := make(TodoItemCollection, 0, len(th.items))
+	for _, item := range th.items {
+		items = append(items, item)
+	}
+	sort.Sort(byPosition(items))
+	return items
+}
+
+// Position for a new item at the end of the list. The caller needs to hold the lock.
+func (th *TodoHandler) nextPosition() float64 {
+	max := 0.0
+	for _, item := range th.items {
+		if item.Position > max {
+			max = item.Position
+		}
+	}
+	return max + positionGap
+}
+
+// Spreads the positions of all items out again using the full gap. The caller needs to hold the write lock.
+func (th *TodoHandler) rebalancePositions() {
+	for i, item := range th.itemsByPosition() {
+		item.Position = float64(i+1) * positionGap
+		th.items[item.Id] = item
+	}
+}
+
+// Makes sure no two items share the same position, otherwise their order would only depend on the id tie breaker. Checking is
+// cheap compared to spreading all items out, so we only rebalance if there actually is a collision. The caller needs to hold
+// the write lock.
+func (th *TodoHandler) ensureUniquePositions() {
+	seen := make(map[float64]bool, len(th.items))
+	for _, item := range th.items {
+		if seen[item.Position] {
+			th.rebalancePositions()
+			return
+		}
+		seen[item.Position] = true
+	}
+}
+
+// Repairs the positions of all items by spreading them out evenly in their current order. Items sharing a position stay
+// ordered by id, so the result is always the same.
+func (th *TodoHandler) NormalizePositions(c *gin.Context) {
+	th.Lock()
+	defer th.Unlock()
+	th.rebalancePositions()
+	if !th.saveOrFail(c) {
+		return
+	}
+	c.JSON(http.StatusOK, th.itemsByPosition())
+}
+
+// The body of a move request. The moved item ends up directly after the item After and before the item Before.
+// One of them may be left out to move the item to the start or the end of the list.
+type MoveTodoItem struct {
+	After  *int
+	Before *int
+}
+
+func (th *TodoHandler) MoveItem(c *gin.Context) {
+	id, err := th.parseID(c.Param("id"))
+	if err != nil {
+		c.String(http.StatusBadRequest, "Bad request: Id in url is not a valid id")
+		return
+	}
+	move := MoveTodoItem{}
+	if err := th.bindJSON(c, &move); err != nil || (move.After == nil && move.Before == nil) {
+		c.String(http.StatusBadRequest, "Bad request: After or Before is required")
+		return
+	}
+	if (move.After != nil && *move.After == id) || (move.Before != nil && *move.Before == id) {
+		c.String(http.StatusBadRequest, "Bad request: An item cannot be moved next to itself")
+		return
+	}
+
+	th.Lock()
+	defer th.Unlock()
+	item, ok := th.lookup(c, id)
+	if !ok {
+		c.String(http.StatusNotFound, `Not found: Item with id "%v"`, id)
+		return
+	}
+	if !checkIfMatch(c, item) {
+		return
+	}
+	for _, neighbour := range []*int{move.After, move.Before} {
+		if neighbour != nil {
+			if _, ok := th.lookup(c, *neighbour); !ok {
+				c.String(http.StatusNotFound, `Not found: Item with id "%v"`, *neighbour)
+				return
+			}
+		}
+	}
+
+	low, high, ok := th.neighbourPositions(id, move)
+	if !ok {
+		c.String(http.StatusBadRequest, "Bad request: After must be placed before Before")
+		return
+	}
+	mid := low + (high-low)/2
+	// With floats the midpoint collapses onto one of the neighbours once we run out of precision. In this case the gap is used up,
+	// so we spread all items out again and retry. After a rebalance there is always enough room.
+	if mid <= low || mid >= high {
+		th.rebalancePositions()
+		low, high, _ = th.neighbourPositions(id, move)
+		mid = low + (high-low)/2
+	}
+	item = th.items[id]
+	item.Position = mid
+	th.items[id] = th.touch(item)
+	th.ensureUniquePositions()
+	if !th.saveOrFail(c) {
+		return
+	}
+	item = th.items[id]
+	c.Header("ETag", itemETag(item))
+	c.JSON(http.StatusOK, item)
+}
+
+// Returns the positions of the neighbours of a move. Returns false if After is not placed before Before.
+// The caller needs to hold the lock.
+func (th *TodoHandler) neighbourPositions(id int, move MoveTodoItem) (float64, float64, bool) {
+	// Look at the list without the moved item to find the missing neighbour if only one is given.
+	items := TodoItemCollection{}
+	for _, item := range th.itemsByPosition() {
+		if item.Id != id {
+			items = append(items, item)
+		}
+	}
+	index := func(id int) int {
+		for i, item := range items {
+			if item.Id == id {
+				return i
+			}
+		}
+		return -1
+	}
+
+	var low, high float64
+	switch {
+	case move.After != nil && move.Before != nil:
+		a, b := index(*move.After), index(*move.Before)
+		if a >= b {
+			return 0, 0, false
+		}
+		low, high = items[a].Position, items[b].Position
+	case move.After != nil:
+		a := index(*move.After)
+		low = items[a].Position
+		if a+1 < len(items) {
+			high = items[a+1].Position
+		} else {
+			high = low + 2*positionGap
+		}
+	default:
+		b := index(*move.Before)
+		high = items[b].Position
+		if b > 0 {
+			low = items[b-1].Position
+		} else {
+			low = high - 2*positionGap
+		}
+	}
+	return low, high, true
+}
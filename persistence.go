@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A TodoStore keeps our items between restarts. The TodoHandler loads all items once on startup using List and keeps working on
+// its own map, as all the rules like dependencies need to see every item anyway. After each change it tells the store which items
+// were created, updated or deleted. That's why only one instance of the service may use a store at a time: a second one would
+// work on its own copy of the items and overwrite the changes of the first.
+type TodoStore interface {
+	Get(id int) (TodoItem, bool, error)
+	List() ([]TodoItem, error)
+	Create(item TodoItem) error
+	Update(item TodoItem) error
+	Delete(id int) error
+}
+
+// Stores which can run several changes as one all or nothing step implement this interface too. The TodoHandler uses it if it's
+// available, so a request changing many items is never stored halfway.
+type transactionalStore interface {
+	Transaction(fn func(store TodoStore) error) error
+}
+
+// Keeps the items in a map and nothing else, so all items are gone after a restart. Used if no other store is configured.
+type memoryStore struct {
+	items map[int]TodoItem
+}
+
+func NewMemoryStore() *memoryStore {
+	return &memoryStore{items: map[int]TodoItem{}}
+}
+
+func (s *memoryStore) Get(id int) (TodoItem, bool, error) {
+	item, ok := s.items[id]
+	return item, ok, nil
+}
+
+func (s *memoryStore) List() ([]TodoItem, error) {
+	list := make(TodoItemCollection, 0, len(s.items))
+	for _, item := range s.items {
+		list = append(list, item)
+	}
+	sort.Sort(list)
+	return list, nil
+}
+
+func (s *memoryStore) Create(item TodoItem) error {
+	s.items[item.Id] = item
+	return nil
+}
+
+func (s *memoryStore) Update(item TodoItem) error {
+	s.items[item.Id] = item
+	return nil
+}
+
+func (s *memoryStore) Delete(id int) error {
+	delete(s.items, id)
+	return nil
+}
+
+// Stores all items as a JSON array in a single file. It's a memory store which writes the whole file after each change.
+type jsonFileStore struct {
+	*memoryStore
+	path string
+}
+
+// Returns a store for the given file. A missing file is a new empty list. A corrupt file is logged and also starts an empty list,
+// as that is better than not starting at all. The broken file gets replaced with the next change.
+func NewJSONFileStore(path string) *jsonFileStore {
+	s := &jsonFileStore{memoryStore: NewMemoryStore(), path: path}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s
+	}
+	list := TodoItemCollection{}
+	if err == nil {
+		err = json.Unmarshal(data, &list)
+	}
+	if err != nil {
+		log.Printf("Loading the items from %v failed, starting with an empty list: %v", path, err)
+		return s
+	}
+	for _, item := range list {
+		s.items[item.Id] = item
+	}
+	return s
+}
+
+func (s *jsonFileStore) Create(item TodoItem) error {
+	return s.change(func(store TodoStore) error { return store.Create(item) })
+}
+
+func (s *jsonFileStore) Update(item TodoItem) error {
+	return s.change(func(store TodoStore) error { return store.Update(item) })
+}
+
+func (s *jsonFileStore) Delete(id int) error {
+	return s.change(func(store TodoStore) error { return store.Delete(id) })
+}
+
+// Writing the file once per change would be slow for requests changing many items, so a transaction only writes at the end.
+func (s *jsonFileStore) Transaction(fn func(store TodoStore) error) error {
+	return s.change(fn)
+}
+
+// Applies the changes to the items in memory and writes the file. If that fails the items go back to what is in the file,
+// otherwise the next write would store the failed changes after all.
+func (s *jsonFileStore) change(fn func(store TodoStore) error) error {
+	backup := copyItems(s.items)
+	err := fn(s.memoryStore)
+	if err == nil {
+		err = s.write()
+	}
+	if err != nil {
+		s.items = backup
+	}
+	return err
+}
+
+func (s *jsonFileStore) write() error {
+	list, _ := s.List()
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+// Writes the data into a temporary file first and then renames it. The data is flushed to disk before the rename, and a rename
+// replaces the old file in one step, so a crash in the middle of writing can never leave a half written file behind.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	// Without this the rename may reach the disk before the data, and a crash would leave an empty file
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Sends all changes since the last save to the store. We compare the items with the copy of what we stored last time, so the
+// handlers don't need to track what they changed. The caller needs to hold the write lock, so two saves never run at the same time.
+// If the store fails, all changes since the last save are undone, so the items in memory never get ahead of the store and a client
+// never gets a success for a change which would be lost with the next restart.
+//
+// Every changed item gets the next Version here, so no change can be missed, including side effects like removing a deleted
+// dependency. Only the position doesn't count: a rebalance moves every item, and the If-Match of all clients would fail although
+// nothing they edited changed. A move the client asked for still changes UpdatedAt and so the version. Handlers which send the
+// changed item back need to read it from th.items after the save to get the new version.
+func (th *TodoHandler) save() error {
+	for id, item := range th.items {
+		old, ok := th.saved[id]
+		old.Position = item.Position
+		if !ok || !reflect.DeepEqual(old, item) {
+			item.Version = old.Version + 1
+			th.items[id] = item
+		}
+	}
+	apply := func(store TodoStore) error {
+		for id, item := range th.items {
+			old, ok := th.saved[id]
+			var err error
+			if !ok {
+				err = store.Create(item)
+			} else if !reflect.DeepEqual(old, item) {
+				err = store.Update(item)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		for id := range th.saved {
+			if _, ok := th.items[id]; !ok {
+				if err := store.Delete(id); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	var err error
+	if ts, ok := th.store.(transactionalStore); ok {
+		err = ts.Transaction(apply)
+	} else {
+		err = apply(th.store)
+	}
+	if err != nil {
+		log.Printf("Saving the items failed: %v", err)
+		th.items = copyItems(th.saved)
+		return err
+	}
+	// Only changes which were saved are published
+	th.events.Publish(th.changeEvents()...)
+	th.saved = copyItems(th.items)
+	return nil
+}
+
+// Saves the changes and answers with a 500 if that fails. On failure the response is already written and false is returned.
+// The caller needs to hold the write lock.
+func (th *TodoHandler) saveOrFail(c *gin.Context) bool {
+	if err := th.save(); err != nil {
+		c.String(http.StatusInternalServerError, "Internal server error: Saving the changes failed")
+		return false
+	}
+	return true
+}
+
+// Returns a copy of the map. The items are values, so changing the copy never changes the original.
+func copyItems(items map[int]TodoItem) map[int]TodoItem {
+	result := make(map[int]TodoItem, len(items))
+	for id, item := range items {
+		result[id] = item
+	}
+	return result
+}
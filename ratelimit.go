@@ -0,0 +1,78 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The rate limit is a token bucket per client IP. Every client starts with a full bucket of burst tokens and every request takes
+// one. The bucket fills up again with rate tokens per second. Short bursts are fine this way, but a client which keeps sending
+// more than rate requests per second gets a 429 until it slows down.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type rateLimiter struct {
+	rate    float64
+	burst   float64
+	buckets map[string]*tokenBucket
+	// When we last removed the buckets of clients we haven't seen in a while
+	swept time.Time
+	sync.Mutex
+}
+
+// Reports whether the client may send a request now. If not, it also returns how long the client has to wait for the next token.
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// A bucket which had enough time to fill up is the same as a new one, so we can forget it. Otherwise every client which ever
+// connected would stay in memory. The caller needs to hold the lock.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < time.Minute {
+		return
+	}
+	l.swept = now
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > full {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// RateLimit returns a Gin middleware which allows every client IP rate requests per second on average with bursts of up to burst
+// requests. Requests over the limit get a 429 with a Retry-After header.
+func RateLimit(rate, burst int) gin.HandlerFunc {
+	limiter := &rateLimiter{rate: float64(rate), burst: float64(burst), buckets: map[string]*tokenBucket{}, swept: time.Now()}
+	return func(c *gin.Context) {
+		ok, wait := limiter.allow(c.ClientIP(), time.Now())
+		if !ok {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			c.String(http.StatusTooManyRequests, "Too many requests: Slow down and retry later")
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The body of a find and replace request. Without Ids all items are searched. With Regex Find is a regular expression and Replace
+// may use $1 style references to its groups.
+type FindReplaceRequest struct {
+	Find    string `binding:"required"`
+	Replace string
+	Regex   bool
+	Ids     []int
+}
+
+// The result of the FindReplace function. Items contains every item whose name changed, or would change for a dry run.
+type FindReplaceResult struct {
+	Items   TodoItemCollection
+	Missing []int
+	DryRun  bool
+}
+
+// Replaces text in the names of many items at once. Either all names are changed or, if one of the new names is invalid, none.
+// With ?dryRun=true nothing is stored and the result shows what would change. The filters of the list like ?tag=project-x limit
+// the replacement to the matching items, also if Ids are given.
+func (th *TodoHandler) FindReplace(c *gin.Context) {
+	dryRun, err := strconv.ParseBool(c.DefaultQuery("dryRun", "false"))
+	if err != nil {
+		c.String(http.StatusBadRequest, "Bad request: dryRun must be true or false")
+		return
+	}
+	filter, ok := parseFilter(c, th.clock.Now())
+	if !ok {
+		return
+	}
+	request := FindReplaceRequest{}
+	if err := th.bindJSON(c, &request); err != nil {
+		c.String(http.StatusBadRequest, bindErrorMessage(err))
+		return
+	}
+	replace := func(name string) string { return strings.Replace(name, request.Find, request.Replace, -1) }
+	if request.Regex {
+		re, err := regexp.Compile(request.Find)
+		if err != nil {
+			c.String(http.StatusBadRequest, "Bad request: Find is not a valid regular expression: %v", err)
+			return
+		}
+		replace = func(name string) string { return re.ReplaceAllString(name, request.Replace) }
+	}
+
+	th.Lock()
+	defer th.Unlock()
+	result := FindReplaceResult{Items: TodoItemCollection{}, Missing: []int{}, DryRun: dryRun}
+	ids := request.Ids
+	if len(ids) == 0 {
+		for _, item := range th.visibleItems(c) {
+			ids = append(ids, item.Id)
+		}
+		sort.Ints(ids)
+	}
+	for _, id := range ids {
+		item, ok := th.lookup(c, id)
+		if !ok {
+			result.Missing = append(result.Missing, id)
+			continue
+		}
+		if !filter.matches(item) {
+			continue
+		}
+		name := replace(item.Name)
+		if name == item.Name {
+			continue
+		}
+		if name, err = validateName(name); err != nil {
+			c.String(http.StatusBadRequest, `Bad request: Item "%v": %v`, id, err)
+			return
+		}
+		// Renaming is a PUT which only changes the name, so the same rules apply
+		putItem := putFromItem(item)
+		putItem.Name = name
+		if !th.checkPut(c, item, putItem) {
+			return
+		}
+		result.Items = append(result.Items, th.touch(applyPut(item, putItem)))
+	}
+
+	if !dryRun && len(result.Items) > 0 {
+		for _, item := range result.Items {
+			th.items[item.Id] = item
+		}
+		if !th.saveOrFail(c) {
+			return
+		}
+		// Saving gave the items their new version
+		for i, item := range result.Items {
+			result.Items[i] = th.items[item.Id]
+		}
+	}
+	c.JSON(http.StatusOK, result)
+}
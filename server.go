@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Runs the server until it receives SIGINT or SIGTERM and then shuts it down gracefully: it stops accepting new connections and
+// waits up to ShutdownTimeout for the running requests to finish. onShutdown is called when the shutdown starts, to end long
+// running requests like the event streams which would otherwise keep the shutdown waiting until the timeout.
+func serve(cfg Config, handler http.Handler, onShutdown func()) error {
+	srv := &http.Server{
+		Addr:    cfg.ListenAddr,
+		Handler: handler,
+		// The headers have to arrive quickly even if the body may take longer, so slow clients can't keep connections open
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+	srv.RegisterOnShutdown(onShutdown)
+
+	errs := make(chan error, 1)
+	go func() {
+		log.Printf("Listening on %v", cfg.ListenAddr)
+		if cfg.TLSCertFile != "" {
+			errs <- srv.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile)
+		} else {
+			errs <- srv.ListenAndServe()
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err := <-errs:
+		// The server never stops on its own, so this is always an error like a port which is already in use
+		return err
+	case sig := <-signals:
+		log.Printf("Received %v, shutting down", sig)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	return srv.Shutdown(ctx)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	// The drivers register themselves with database/sql, we never use them directly
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// The methods shared by *sql.DB and *sql.Tx, so the same code works inside and outside of a transaction.
+type sqlQueryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Stores the items in a SQL database. Name and IsComplete get their own columns so they are easy to query by hand. The whole item
+// is stored as JSON in the data column, so new fields of TodoItem don't need a schema change.
+//
+// SQLite and Postgres both understand the SQL below, including the $1 placeholders.
+type sqlStore struct {
+	db sqlQueryer
+}
+
+const createTableSQL = `CREATE TABLE IF NOT EXISTS todo_items (
+	id INTEGER PRIMARY KEY,
+	name TEXT NOT NULL,
+	is_complete BOOLEAN NOT NULL,
+	data TEXT NOT NULL
+)`
+
+// Opens the database using a driver name like "sqlite3" or "postgres" and creates the table if it doesn't exist yet.
+func NewSQLStore(driver, dsn string) (*sqlStore, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(createTableSQL); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating the todo_items table failed: %v", err)
+	}
+	return &sqlStore{db: db}, nil
+}
+
+func (s *sqlStore) Get(id int) (TodoItem, bool, error) {
+	var data string
+	err := s.db.QueryRow("SELECT data FROM todo_items WHERE id = $1", id).Scan(&data)
+	if err == sql.ErrNoRows {
+		return TodoItem{}, false, nil
+	}
+	if err != nil {
+		return TodoItem{}, false, err
+	}
+	item := TodoItem{}
+	err = json.Unmarshal([]byte(data), &item)
+	return item, err == nil, err
+}
+
+func (s *sqlStore) List() ([]TodoItem, error) {
+	rows, err := s.db.Query("SELECT data FROM todo_items ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []TodoItem{}
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		item := TodoItem{}
+		if err := json.Unmarshal([]byte(data), &item); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+func (s *sqlStore) Create(item TodoItem) error {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec("INSERT INTO todo_items (id, name, is_complete, data) VALUES ($1, $2, $3, $4)",
+		item.Id, item.Name, item.IsComplete, string(data))
+	return err
+}
+
+func (s *sqlStore) Update(item TodoItem) error {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	// SQLite numbers the placeholders in the order they appear, so they have to be in ascending order
+	_, err = s.db.Exec("UPDATE todo_items SET name = $1, is_complete = $2, data = $3 WHERE id = $4",
+		item.Name, item.IsComplete, string(data), item.Id)
+	return err
+}
+
+func (s *sqlStore) Delete(id int) error {
+	_, err := s.db.Exec("DELETE FROM todo_items WHERE id = $1", id)
+	return err
+}
+
+// Runs all changes of fn in one database transaction. If fn fails nothing is stored.
+func (s *sqlStore) Transaction(fn func(store TodoStore) error) error {
+	db, ok := s.db.(*sql.DB)
+	if !ok {
+		// Already inside of a transaction
+		return fn(s)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(&sqlStore{db: tx}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Closes the database connection on shutdown.
+func (s *sqlStore) Close() error {
+	if db, ok := s.db.(*sql.DB); ok {
+		return db.Close()
+	}
+	return nil
+}
+
+// Creates the store selected in the configuration.
+func NewStore(cfg Config) (TodoStore, error) {
+	switch cfg.Store {
+	case "", "memory":
+		if cfg.DataFile != "" {
+			// Setting only the data file has always been enough to store the items in a file
+			return NewJSONFileStore(cfg.DataFile), nil
+		}
+		return NewMemoryStore(), nil
+	case "file":
+		if cfg.DataFile == "" {
+			return nil, fmt.Errorf("the file store requires TODO_DATA_FILE")
+		}
+		return NewJSONFileStore(cfg.DataFile), nil
+	case "sqlite":
+		dsn := cfg.DatabaseDSN
+		if dsn == "" {
+			dsn = "todos.db"
+		}
+		return NewSQLStore("sqlite3", dsn)
+	case "postgres":
+		if cfg.DatabaseDSN == "" {
+			return nil, fmt.Errorf("the postgres store requires TODO_DATABASE_DSN")
+		}
+		return NewSQLStore("postgres", cfg.DatabaseDSN)
+	}
+	return nil, fmt.Errorf("unknown store %q", cfg.Store)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// One item of the desired state of a sync. Items without an Id, or with an Id we don't know, are created. Ids are always assigned
+// by the server, so a created item gets a new id.
+type DesiredTodoItem struct {
+	Id              int
+	Name            string
+	IsComplete      bool
+	EstimateMinutes *int
+	DependsOn       []int
+	DueDate         *time.Time
+	Priority        string
+	Tags            []string
+}
+
+// An update in a sync plan, listing the fields that would change.
+type PlannedUpdate struct {
+	Id      int
+	Changes map[string]FieldChange
+}
+
+// What has to be done to turn the stored items into the desired state. Items which already match are in neither list.
+type SyncPlan struct {
+	Creates []DesiredTodoItem
+	Updates []PlannedUpdate
+	Deletes []int
+}
+
+// Reads the desired state from the body. On failure the response is already written and false is returned.
+func (th *TodoHandler) bindDesiredItems(c *gin.Context) ([]DesiredTodoItem, bool) {
+	desired := []DesiredTodoItem{}
+	if err := th.bindJSON(c, &desired); err != nil {
+		c.String(http.StatusBadRequest, bindErrorMessage(err))
+		return nil, false
+	}
+	seen := map[int]bool{}
+	for i := range desired {
+		// Gin only runs the binding validation for structs, not for the items of a slice, so we validate every item ourselves
+		putItem := desired[i].putItem()
+		if err := validatePut(&putItem); err != nil {
+			c.String(http.StatusBadRequest, "Bad request: Item %v: %v", i, err)
+			return nil, false
+		}
+		desired[i].Name, desired[i].Priority, desired[i].Tags = putItem.Name, putItem.Priority, putItem.Tags
+		if id := desired[i].Id; id != 0 {
+			if seen[id] {
+				c.String(http.StatusBadRequest, `Bad request: Item with id "%v" is listed twice`, id)
+				return nil, false
+			}
+			seen[id] = true
+		}
+	}
+	return desired, true
+}
+
+// The PUT body which makes a stored item look like the desired one.
+func (d DesiredTodoItem) putItem() PutTodoItem {
+	return PutTodoItem{
+		Name:            d.Name,
+		IsComplete:      d.IsComplete,
+		EstimateMinutes: d.EstimateMinutes,
+		DependsOn:       d.DependsOn,
+		DueDate:         d.DueDate,
+		Priority:        d.Priority,
+		Tags:            d.Tags,
+	}
+}
+
+// Compares the desired state with the stored items visible to the request. The caller needs to hold the lock.
+func (th *TodoHandler) planSync(c *gin.Context, desired []DesiredTodoItem) SyncPlan {
+	plan := SyncPlan{Creates: []DesiredTodoItem{}, Updates: []PlannedUpdate{}, Deletes: []int{}}
+	kept := map[int]bool{}
+	for _, d := range desired {
+		item, ok := th.lookup(c, d.Id)
+		if !ok {
+			plan.Creates = append(plan.Creates, d)
+			continue
+		}
+		kept[d.Id] = true
+		if changes := diffItems(item, applyPut(item, d.putItem())); len(changes) > 0 {
+			plan.Updates = append(plan.Updates, PlannedUpdate{Id: d.Id, Changes: changes})
+		}
+	}
+	for _, item := range th.visibleItems(c) {
+		if !kept[item.Id] {
+			plan.Deletes = append(plan.Deletes, item.Id)
+		}
+	}
+	sort.Ints(plan.Deletes)
+	return plan
+}
+
+// Remembers the current items and returns a function which goes back to them, for requests which change many items and have
+// to undo everything if one of them fails. The caller needs to hold the write lock until it either saved or rolled back.
+func (th *TodoHandler) snapshot() func() {
+	backup, lastID := copyItems(th.items), th.lastID
+	return func() {
+		th.items, th.lastID = backup, lastID
+	}
+}
+
+// Returns the creates, updates and deletes needed to reach the desired state in the body, without applying them.
+func (th *TodoHandler) PlanSync(c *gin.Context) {
+	desired, ok := th.bindDesiredItems(c)
+	if !ok {
+		return
+	}
+	th.RLock()
+	defer th.RUnlock()
+	c.JSON(http.StatusOK, th.planSync(c, desired))
+}
+
+// Applies the desired state in the body. Missing items are only deleted with ?deleteMissing=true, so a forgotten item in the body
+// can't wipe the list by accident. Everything happens under one write lock, and if one item is invalid all changes are rolled back.
+func (th *TodoHandler) Sync(c *gin.Context) {
+	deleteMissing, err := strconv.ParseBool(c.DefaultQuery("deleteMissing", "false"))
+	if err != nil {
+		c.String(http.StatusBadRequest, "Bad request: deleteMissing must be true or false")
+		return
+	}
+	desired, ok := th.bindDesiredItems(c)
+	if !ok {
+		return
+	}
+
+	th.Lock()
+	defer th.Unlock()
+	openBefore := th.openItems(ownerOf(c))
+	rollback := th.snapshot()
+
+	plan := th.planSync(c, desired)
+	// Deletes go first, so the dependencies of the other items are checked against the final list
+	if deleteMissing {
+		for _, id := range plan.Deletes {
+			delete(th.items, id)
+			th.removeDependency(id)
+		}
+	}
+	for _, d := range desired {
+		item, ok := th.lookup(c, d.Id)
+		if !ok {
+			continue
+		}
+		if !th.checkPut(c, item, d.putItem()) {
+			rollback()
+			return
+		}
+		if updated := applyPut(item, d.putItem()); len(diffItems(item, updated)) > 0 {
+			th.items[d.Id] = th.touch(updated)
+		}
+	}
+	for _, d := range plan.Creates {
+		if status, msg := th.createRules(ownerOf(c), d.putItem()); status != 0 {
+			rollback()
+			c.String(status, msg)
+			return
+		}
+		th.create(ownerOf(c), d.putItem())
+	}
+	if open := th.openItems(ownerOf(c)); th.maxOpenItems > 0 && open > th.maxOpenItems && open > openBefore {
+		rollback()
+		c.String(http.StatusConflict, "Conflict: The limit of %v open items is reached, complete an item first", th.maxOpenItems)
+		return
+	}
+
+	th.ensureUniquePositions()
+	if !th.saveOrFail(c) {
+		return
+	}
+	items := th.visibleItems(c)
+	sort.Sort(items)
+	c.JSON(http.StatusOK, items)
+}
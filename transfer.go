@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The columns of a CSV export. Lists like DependsOn and Tags are joined with a semicolon.
+var csvColumns = []string{"Id", "Name", "IsComplete", "EstimateMinutes", "DependsOn", "DueDate", "Priority", "Tags", "CreatedAt", "UpdatedAt", "CompletedAt"}
+
+const csvListSeparator = ";"
+
+// Returns all items as a file download. ?format= is either json, the default, or csv.
+func (th *TodoHandler) Export(c *gin.Context) {
+	format := c.DefaultQuery("format", "json")
+	if format != "json" && format != "csv" {
+		c.String(http.StatusBadRequest, `Bad request: format must be "json" or "csv"`)
+		return
+	}
+	th.RLock()
+	items := th.visibleItems(c)
+	th.RUnlock()
+	sort.Sort(items)
+
+	c.Header("Content-Disposition", `attachment; filename="todos.`+format+`"`)
+	if format == "json" {
+		c.JSON(http.StatusOK, items)
+		return
+	}
+	// We write the CSV into a buffer first, so an error doesn't leave a half written file behind
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(csvColumns)
+	for _, item := range items {
+		w.Write(csvRecord(item))
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		c.String(http.StatusInternalServerError, "Internal server error: Writing the CSV failed")
+		return
+	}
+	c.Data(http.StatusOK, "text/csv; charset=utf-8", buf.Bytes())
+}
+
+// Turns an item into a CSV row in the order of csvColumns. Missing optional values are empty cells.
+func csvRecord(item TodoItem) []string {
+	estimate, dueDate, completedAt := "", "", ""
+	if item.EstimateMinutes != nil {
+		estimate = strconv.Itoa(*item.EstimateMinutes)
+	}
+	if item.DueDate != nil {
+		dueDate = item.DueDate.Format(time.RFC3339)
+	}
+	if item.CompletedAt != nil {
+		completedAt = item.CompletedAt.Format(time.RFC3339)
+	}
+	deps := make([]string, len(item.DependsOn))
+	for i, dep := range item.DependsOn {
+		deps[i] = strconv.Itoa(dep)
+	}
+	return []string{
+		strconv.Itoa(item.Id),
+		item.Name,
+		strconv.FormatBool(item.IsComplete),
+		estimate,
+		strings.Join(deps, csvListSeparator),
+		dueDate,
+		item.Priority,
+		strings.Join(item.Tags, csvListSeparator),
+		item.CreatedAt.Format(time.RFC3339),
+		item.UpdatedAt.Format(time.RFC3339),
+		completedAt,
+	}
+}
+
+// One item of an import. Ids and dependencies only mean something in the tool the items come from, so they are not imported.
+// Every imported item gets a new id.
+type ImportedTodoItem struct {
+	Name            string
+	IsComplete      bool
+	EstimateMinutes *int
+	DueDate         *time.Time
+	Priority        string
+	Tags            []string
+}
+
+func (item ImportedTodoItem) putItem() PutTodoItem {
+	return PutTodoItem{
+		Name:            item.Name,
+		IsComplete:      item.IsComplete,
+		EstimateMinutes: item.EstimateMinutes,
+		DueDate:         item.DueDate,
+		Priority:        item.Priority,
+		Tags:            item.Tags,
+	}
+}
+
+// A row of the import which couldn't be imported. For JSON the first item is row 1, for CSV the header is row 1.
+type ImportError struct {
+	Row     int
+	Message string
+}
+
+// The result of the Import function.
+type ImportResult struct {
+	Imported int
+	Errors   []ImportError
+}
+
+// Imports the items of a JSON or CSV file. The file is either sent as the "file" field of a multipart form or as the plain body.
+// The format is taken from ?format=, the file name or the Content-Type, in this order, and defaults to JSON. JSON files contain
+// an array of items like the JSON export, CSV files need a header row with at least a Name column and may use every column of
+// the CSV export. Unknown columns are ignored.
+//
+// Every row is checked before anything is stored. If a row is invalid nothing is imported and all errors are returned with a
+// 422, so the file can be fixed in one go. With ?skipInvalid=true the valid rows are imported anyway. The rows are stored all or
+// nothing, so if the store fails none of them are imported. Due dates in the past are allowed here, as migrated items may already
+// be overdue.
+func (th *TodoHandler) Import(c *gin.Context) {
+	skipInvalid, err := strconv.ParseBool(c.DefaultQuery("skipInvalid", "false"))
+	if err != nil {
+		c.String(http.StatusBadRequest, "Bad request: skipInvalid must be true or false")
+		return
+	}
+	data, filename, err := readUpload(c)
+	if err != nil {
+		c.String(http.StatusBadRequest, "Bad request: Reading the file failed: %v", err)
+		return
+	}
+	format := c.Query("format")
+	if format == "" {
+		switch {
+		case strings.EqualFold(filepath.Ext(filename), ".csv"), strings.Contains(c.ContentType(), "csv"):
+			format = "csv"
+		default:
+			format = "json"
+		}
+	}
+
+	var rows []importRow
+	var errs []ImportError
+	switch format {
+	case "json":
+		rows, errs, err = parseJSONImport(data)
+	case "csv":
+		rows, errs, err = parseCSVImport(data)
+	default:
+		c.String(http.StatusBadRequest, `Bad request: format must be "json" or "csv"`)
+		return
+	}
+	if err != nil {
+		c.String(http.StatusBadRequest, "Bad request: %v", err)
+		return
+	}
+
+	// The rows which passed parsing still have to pass the same validation as a PUT
+	valid := []PutTodoItem{}
+	for i, row := range rows {
+		if row.ImportedTodoItem == nil {
+			continue
+		}
+		putItem := row.putItem()
+		if err := validatePut(&putItem); err != nil {
+			errs = append(errs, ImportError{Row: rowNumber(format, i), Message: err.Error()})
+			continue
+		}
+		valid = append(valid, putItem)
+	}
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Row < errs[j].Row })
+	result := ImportResult{Errors: errs}
+	if result.Errors == nil {
+		result.Errors = []ImportError{}
+	}
+	if len(rows) == 0 && len(errs) == 0 {
+		c.String(http.StatusBadRequest, "Bad request: The file contains no items")
+		return
+	}
+	if len(errs) > 0 && !skipInvalid {
+		c.JSON(http.StatusUnprocessableEntity, result)
+		return
+	}
+	if len(valid) == 0 {
+		c.JSON(http.StatusOK, result)
+		return
+	}
+
+	th.Lock()
+	defer th.Unlock()
+	opened := 0
+	for _, putItem := range valid {
+		if !putItem.IsComplete {
+			opened++
+		}
+	}
+	if th.maxOpenItems > 0 && opened > 0 && th.openItems(ownerOf(c))+opened > th.maxOpenItems {
+		c.String(http.StatusConflict, "Conflict: The import would exceed the limit of %v open items", th.maxOpenItems)
+		return
+	}
+	rollback := th.snapshot()
+	for _, putItem := range valid {
+		th.create(ownerOf(c), putItem)
+	}
+	th.ensureUniquePositions()
+	if err := th.save(); err != nil {
+		rollback()
+		c.String(http.StatusInternalServerError, "Internal server error: Saving the changes failed")
+		return
+	}
+	result.Imported = len(valid)
+	th.warnOpenItemsLimit(c, th.openItems(ownerOf(c)))
+	c.JSON(http.StatusCreated, result)
+}
+
+// Returns the uploaded file and its name. Without a multipart form the body is the file and the name is empty.
+func readUpload(c *gin.Context) ([]byte, string, error) {
+	if !strings.HasPrefix(c.ContentType(), "multipart/") {
+		data, err := c.GetRawData()
+		return data, "", err
+	}
+	header, err := c.FormFile("file")
+	if err != nil {
+		return nil, "", err
+	}
+	file, err := header.Open()
+	if err != nil {
+		return nil, "", err
+	}
+	defer file.Close()
+	data, err := ioutil.ReadAll(file)
+	return data, header.Filename, err
+}
+
+// The row number of the i-th item in the file, see ImportError.
+func rowNumber(format string, i int) int {
+	if format == "csv" {
+		return i + 2
+	}
+	return i + 1
+}
+
+// A parsed row. Rows which couldn't be parsed keep their place as nil, so the row numbers of the others stay right.
+type importRow struct {
+	*ImportedTodoItem
+}
+
+// Parses a JSON array of items. Every item is decoded on its own, so one broken item doesn't hide the errors of the others.
+// The error is only set if the file isn't an array at all.
+func parseJSONImport(data []byte) ([]importRow, []ImportError, error) {
+	raw := []json.RawMessage{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, nil, fmt.Errorf("The file is not a JSON array of items: %v", err)
+	}
+	rows := make([]importRow, len(raw))
+	errs := []ImportError{}
+	for i, r := range raw {
+		item := ImportedTodoItem{}
+		if err := json.Unmarshal(r, &item); err != nil {
+			errs = append(errs, ImportError{Row: i + 1, Message: err.Error()})
+			continue
+		}
+		rows[i].ImportedTodoItem = &item
+	}
+	return rows, errs, nil
+}
+
+// Parses a CSV file with a header row. The error is only set if the header is missing or unusable.
+func parseCSVImport(data []byte) ([]importRow, []ImportError, error) {
+	r := csv.NewReader(bytes.NewReader(data))
+	// Rows with a wrong number of cells are reported per row instead of failing the whole file
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil {
+		return nil, nil, fmt.Errorf("The file has no CSV header: %v", err)
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if _, ok := columns["name"]; !ok {
+		return nil, nil, fmt.Errorf("The CSV header has no Name column")
+	}
+
+	rows := []importRow{}
+	errs := []ImportError{}
+	for {
+		record, err := r.Read()
+		if err != nil {
+			if parseErr, ok := err.(*csv.ParseError); ok {
+				// A broken quote can't be skipped, the rest of the file is unreadable
+				errs = append(errs, ImportError{Row: len(rows) + 2, Message: parseErr.Error()})
+			}
+			break
+		}
+		if len(record) != len(header) {
+			errs = append(errs, ImportError{Row: len(rows) + 2, Message: fmt.Sprintf("Row has %v cells but the header has %v", len(record), len(header))})
+			rows = append(rows, importRow{})
+			continue
+		}
+		item, err := parseCSVItem(record, columns)
+		if err != nil {
+			errs = append(errs, ImportError{Row: len(rows) + 2, Message: err.Error()})
+			rows = append(rows, importRow{})
+			continue
+		}
+		rows = append(rows, importRow{&item})
+	}
+	return rows, errs, nil
+}
+
+// Reads an item out of a CSV row. Empty cells keep the default value of the field.
+func parseCSVItem(record []string, columns map[string]int) (ImportedTodoItem, error) {
+	cell := func(name string) string {
+		if i, ok := columns[strings.ToLower(name)]; ok {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+	item := ImportedTodoItem{Name: cell("Name"), Priority: cell("Priority")}
+	if v := cell("IsComplete"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return item, fmt.Errorf("IsComplete must be true or false")
+		}
+		item.IsComplete = b
+	}
+	if v := cell("EstimateMinutes"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return item, fmt.Errorf("EstimateMinutes must be a number")
+		}
+		item.EstimateMinutes = &n
+	}
+	if v := cell("DueDate"); v != "" {
+		// Spreadsheets often only have a date, so we accept that besides a full timestamp
+		due, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			if due, err = time.Parse("2006-01-02", v); err != nil {
+				return item, fmt.Errorf("DueDate must be a date like 2006-01-02 or 2006-01-02T15:04:05Z")
+			}
+		}
+		item.DueDate = &due
+	}
+	if v := cell("Tags"); v != "" {
+		item.Tags = strings.Split(v, csvListSeparator)
+	}
+	return item, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+)
+
+// Names are limited so nobody can store a megabyte of text as a single todo.
+const maxNameLength = 200
+
+// Checks a name and returns it without surrounding whitespace. The binding tags already reject a missing name, but a name of only
+// spaces passes them, so we have to trim and check it ourselves.
+func validateName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", errors.New("Name must not be empty")
+	}
+	if len([]rune(name)) > maxNameLength {
+		return "", fmt.Errorf("Name must not be longer than %v characters", maxNameLength)
+	}
+	return name, nil
+}
+
+// The allowed priorities, from lowest to highest. Items without a priority get the default.
+var priorities = []string{"low", "normal", "high"}
+
+const defaultPriority = "normal"
+
+// Tags are short labels, so we keep both their length and number small.
+const (
+	maxTagLength = 30
+	maxTags      = 10
+)
+
+// Checks a priority and returns it in lower case. An empty priority becomes the default.
+func validatePriority(priority string) (string, error) {
+	priority = strings.ToLower(strings.TrimSpace(priority))
+	if priority == "" {
+		return defaultPriority, nil
+	}
+	for _, p := range priorities {
+		if p == priority {
+			return priority, nil
+		}
+	}
+	return "", fmt.Errorf(`Priority must be one of "%v"`, strings.Join(priorities, `", "`))
+}
+
+// Checks the tags and returns them trimmed, in lower case and without duplicates, so "Work" and "work " are the same tag.
+func validateTags(tags []string) ([]string, error) {
+	result := []string{}
+	seen := map[string]bool{}
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" {
+			return nil, errors.New("Tags must not be empty")
+		}
+		if len([]rune(tag)) > maxTagLength {
+			return nil, fmt.Errorf("Tags must not be longer than %v characters", maxTagLength)
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			result = append(result, tag)
+		}
+	}
+	if len(result) > maxTags {
+		return nil, fmt.Errorf("An item must not have more than %v tags", maxTags)
+	}
+	// Like DependsOn, no tags are stored as nil, so an empty list doesn't count as a change
+	if len(result) == 0 {
+		return nil, nil
+	}
+	return result, nil
+}
+
+// Checks all fields of a PUT body which don't depend on other items and normalizes them.
+func validatePut(putItem *PutTodoItem) error {
+	var err error
+	if putItem.Name, err = validateName(putItem.Name); err != nil {
+		return err
+	}
+	if putItem.EstimateMinutes != nil && *putItem.EstimateMinutes < 0 {
+		return errors.New("EstimateMinutes must not be negative")
+	}
+	if putItem.Priority, err = validatePriority(putItem.Priority); err != nil {
+		return err
+	}
+	putItem.Tags, err = validateTags(putItem.Tags)
+	return err
+}
+
+// Checks that a due date isn't in the past. Only a new or changed due date is checked, otherwise an overdue item could never be
+// changed again without moving its due date.
+func (th *TodoHandler) checkDueDate(old, new *time.Time) error {
+	if new == nil || (old != nil && old.Equal(*new)) {
+		return nil
+	}
+	if new.Before(th.clock.Now()) {
+		return errors.New("DueDate must not be in the past")
+	}
+	return nil
+}
+
+// Turns the error of bindJSON into a message for the client. For failed binding tags we name the field, everything else is
+// just a body we couldn't parse.
+func bindErrorMessage(err error) string {
+	var validationErrors validator.ValidationErrors
+	if errors.As(err, &validationErrors) && len(validationErrors) > 0 {
+		field := validationErrors[0]
+		switch field.Tag() {
+		case "required":
+			return fmt.Sprintf("Bad request: %v is required", field.Field())
+		case "max":
+			return fmt.Sprintf("Bad request: %v must not be longer than %v characters", field.Field(), field.Param())
+		}
+		return fmt.Sprintf("Bad request: %v is invalid", field.Field())
+	}
+	return "Bad request: Body is not valid JSON"
+}